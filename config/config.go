@@ -0,0 +1,64 @@
+// Protection of config files the admin has edited, shared by wield and spack so that both keep them the same way.
+package config
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/cam72cam/go-lumberjack/log"
+)
+
+// A package's new version of a config file the admin has edited is installed next to it with this suffix
+const NewSuffix = ".spacknew"
+
+// Files under these dirs are treated as config
+var Dirs = []string{"/etc/"}
+
+func IsConfig(p string) bool {
+	for _, dir := range Dirs {
+		if strings.HasPrefix(p, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// The md5 packages record for their files
+func Hash(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Puts the edited file back after an install, keeping a changed packaged version as file+NewSuffix
+func Restore(file string, edited []byte, mode os.FileMode, hash string) {
+	current, err := ioutil.ReadFile(file)
+	if err == nil && bytes.Equal(current, edited) {
+		return
+	}
+	replaced := err == nil && Hash(current) != hash
+	if replaced {
+		err = os.Rename(file, file+NewSuffix)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err == nil {
+		err = ioutil.WriteFile(file, edited, mode)
+	}
+	if err == nil {
+		err = os.Chmod(file, mode)
+	}
+	if err != nil {
+		log.Warn.Format("Unable to preserve your modified %s: %s", file, err)
+		return
+	}
+
+	if replaced {
+		log.Warn.Format("Kept your modified %s, the new version was installed as %s%s", file, file, NewSuffix)
+	} else {
+		log.Info.Format("Kept your modified %s", file)
+	}
+}
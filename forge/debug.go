@@ -0,0 +1,239 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/md5"
+	"debug/elf"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/cam72cam/go-lumberjack/log"
+)
+
+const debugDir = "usr/lib/debug"
+
+// Debug info split out of the forged binaries ends up in <name>-dbg
+var debugSubPackage = SubPackage{Suffix: "dbg", Globs: []string{debugDir}}
+
+// Returns the hex GNU build-id of e, or "" if it has none
+func buildID(e *elf.File) string {
+	section := e.Section(".note.gnu.build-id")
+	if section == nil {
+		return ""
+	}
+	data, err := section.Data()
+	if err != nil || len(data) < 16 {
+		return ""
+	}
+
+	order := e.ByteOrder
+	namesz := order.Uint32(data[0:4])
+	descsz := order.Uint32(data[4:8])
+	if order.Uint32(data[8:12]) != 3 { //NT_GNU_BUILD_ID
+		return ""
+	}
+	start := 12 + (namesz+3)&^3
+	if uint32(len(data)) < start+descsz {
+		return ""
+	}
+	return hex.EncodeToString(data[start : start+descsz])
+}
+
+// Where the debug info of the binary at p is installed
+func debugPath(p string, id string) string {
+	if len(id) > 2 {
+		return path.Join(debugDir, ".build-id", id[:2], id[2:]+".debug")
+	}
+	return path.Join(debugDir, strings.TrimPrefix(p, "/")+".debug")
+}
+
+// Strips the binary in data, returning the stripped binary and its separate debug info
+func stripDebug(name string, data []byte, exe bool) ([]byte, []byte, error) {
+	dir, err := ioutil.TempDir(os.TempDir(), "forge-debug")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	bin := filepath.Join(dir, name)
+	dbg := bin + ".debug"
+	err = ioutil.WriteFile(bin, data, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stripMode := "--strip-unneeded"
+	if exe {
+		stripMode = "--strip-all"
+	}
+	cmds := []*exec.Cmd{
+		exec.Command("objcopy", "--only-keep-debug", bin, dbg),
+		exec.Command("strip", stripMode, bin),
+		exec.Command("objcopy", "--add-gnu-debuglink="+dbg, bin),
+	}
+	for _, cmd := range cmds {
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %s", strings.Join(cmd.Args[:2], " "), strings.TrimSpace(string(out)))
+		}
+	}
+
+	stripped, err := ioutil.ReadFile(bin)
+	if err != nil {
+		return nil, nil, err
+	}
+	debug, err := ioutil.ReadFile(dbg)
+	return stripped, debug, err
+}
+
+// Updates a path keyed md5sums entry for changed and added files, leaving other formats alone
+func updateSums(content []byte, changed map[string][]byte) []byte {
+	var sums map[string]interface{}
+	if json.Unmarshal(content, &sums) != nil {
+		return content
+	}
+
+	keys := make(map[string]string)
+	prefix := "/"
+	for key := range sums {
+		keys[path.Clean("/"+key)] = key
+		if !strings.HasPrefix(key, "/") {
+			prefix = strings.TrimSuffix(key, strings.TrimLeft(key, "./"))
+		}
+	}
+
+	for p, data := range changed {
+		key, exists := keys[p]
+		if !exists {
+			key = prefix + strings.TrimPrefix(p, "/")
+		}
+		sum := md5.Sum(data)
+		sums[key] = hex.EncodeToString(sum[:])
+	}
+
+	updated, err := json.MarshalIndent(sums, "", "\t")
+	if err != nil {
+		return content
+	}
+	return updated
+}
+
+// Moves debug info of the spakg's binaries under /usr/lib/debug, returning whether there was any
+func SplitDebug(file string) (bool, error) {
+	for _, prog := range []string{"objcopy", "strip"} {
+		if _, err := exec.LookPath(prog); err != nil {
+			log.Warn.Format("%s not found, debug info will not be split", prog)
+			return false, nil
+		}
+	}
+
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false, err
+	}
+	outerCompressed := isGzip(raw)
+	outerData, ok := unwrapTar(raw)
+	if !ok {
+		return false, fmt.Errorf("%s is not a spakg", file)
+	}
+	outer, err := readEntries(outerData)
+	if err != nil {
+		return false, err
+	}
+
+	changed := make(map[string][]byte)
+	for i, e := range outer {
+		inner, ok := unwrapTar(e.data)
+		if !ok {
+			continue
+		}
+		entries, err := readEntries(inner)
+		if err != nil {
+			return false, fmt.Errorf("%s: %s", e.hdr.Name, err)
+		}
+
+		namePrefix := ""
+		if len(entries) > 0 && strings.HasPrefix(entries[0].hdr.Name, "./") {
+			namePrefix = "./"
+		}
+		dirs := make(map[string]bool)
+		for _, fe := range entries {
+			if fe.hdr.Typeflag == tar.TypeDir {
+				dirs[path.Clean("/"+fe.hdr.Name)] = true
+			}
+		}
+
+		added := make([]tarEntry, 0)
+		addDirs := func(p string) {
+			for dir := path.Dir(p); dir != "/" && !dirs[dir]; dir = path.Dir(dir) {
+				dirs[dir] = true
+				added = append(added, tarEntry{&tar.Header{
+					Name:     namePrefix + strings.TrimPrefix(dir, "/") + "/",
+					Typeflag: tar.TypeDir,
+					Mode:     0755,
+				}, nil})
+			}
+		}
+
+		for j, fe := range entries {
+			p := path.Clean("/" + fe.hdr.Name)
+			if fe.hdr.Typeflag != tar.TypeReg || strings.HasPrefix(p, "/"+debugDir+"/") || len(fe.data) < 4 || string(fe.data[:4]) != elf.ELFMAG {
+				continue
+			}
+			bin, err := elf.NewFile(bytes.NewReader(fe.data))
+			if err != nil || (bin.Type != elf.ET_EXEC && bin.Type != elf.ET_DYN) || bin.Section(".debug_info") == nil {
+				continue
+			}
+			id := buildID(bin)
+
+			stripped, debug, err := stripDebug(path.Base(p), fe.data, bin.Type == elf.ET_EXEC)
+			if err != nil {
+				return false, fmt.Errorf("Unable to split debug info from %s: %s", p, err)
+			}
+			entries[j].data = stripped
+			changed[p] = stripped
+
+			dp := "/" + debugPath(p, id)
+			addDirs(dp)
+			added = append(added, tarEntry{&tar.Header{
+				Name:     namePrefix + strings.TrimPrefix(dp, "/"),
+				Typeflag: tar.TypeReg,
+				Mode:     0644,
+			}, debug})
+			changed[dp] = debug
+			log.Debug.Format("Split debug info of %s into %s", p, dp)
+		}
+
+		if len(added) == 0 {
+			continue
+		}
+		outer[i].data, err = writeEntries(append(entries, added...), isGzip(e.data))
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if len(changed) == 0 {
+		return false, nil
+	}
+
+	for i, e := range outer {
+		if path.Base(e.hdr.Name) == "md5sums" {
+			outer[i].data = updateSums(e.data, changed)
+		}
+	}
+
+	data, err := writeEntries(outer, outerCompressed)
+	if err != nil {
+		return false, err
+	}
+	return true, ioutil.WriteFile(file, data, 0644)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/serenitylinux/libspack/spdl"
+)
+
+// Compiles a small program with debug info, skipping the test without a compiler
+func testBinary(t *testing.T, dir string) []byte {
+	if _, err := exec.LookPath("cc"); err != nil {
+		t.Skip("cc not found")
+	}
+	src := filepath.Join(dir, "tool.c")
+	err := ioutil.WriteFile(src, []byte("int main(void) { return 0; }\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(dir, "tool")
+	out, err := exec.Command("cc", "-g", "-Wl,--build-id", "-o", bin, src).CombinedOutput()
+	if err != nil {
+		t.Skipf("Unable to compile a test binary: %s", out)
+	}
+	data, err := ioutil.ReadFile(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func hasDebugInfo(t *testing.T, data []byte) bool {
+	e, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e.Section(".debug_info") != nil
+}
+
+func TestSplitDebug(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forge-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	binary := testBinary(t, dir)
+
+	tests := []struct {
+		name  string
+		files map[string][]byte
+		split bool
+	}{
+		{"no binaries", map[string][]byte{"usr/share/doc/README": []byte("readme")}, false},
+		{"not elf", map[string][]byte{"usr/bin/script": []byte("#!/bin/sh\n")}, false},
+		{"binary", map[string][]byte{"usr/bin/tool": binary, "usr/share/doc/README": []byte("readme")}, true},
+	}
+
+	for _, test := range tests {
+		testDir, err := ioutil.TempDir(dir, "split")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := writeTestSpakg(t, testDir, test.files)
+
+		split, err := SplitDebug(file)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if split != test.split {
+			t.Errorf("%s: expected split %t, got %t", test.name, test.split, split)
+		}
+
+		s := readTestSpakg(t, file)
+		debugFiles := make([]string, 0)
+		for _, p := range s.paths() {
+			if strings.HasPrefix(p, debugDir+"/") {
+				debugFiles = append(debugFiles, p)
+			} else if _, exists := test.files[p]; !exists {
+				t.Errorf("%s: unexpected %s", test.name, p)
+			}
+		}
+		if !test.split {
+			if len(debugFiles) > 0 {
+				t.Errorf("%s: unexpected debug info %v", test.name, debugFiles)
+			}
+			continue
+		}
+
+		if len(debugFiles) != 1 || !strings.HasPrefix(debugFiles[0], debugDir+"/.build-id/") {
+			t.Fatalf("%s: expected debug info under the build-id, got %v", test.name, debugFiles)
+		}
+		if hasDebugInfo(t, s.files["usr/bin/tool"]) {
+			t.Errorf("%s: usr/bin/tool still has debug info", test.name)
+		}
+		if !hasDebugInfo(t, s.files[debugFiles[0]]) {
+			t.Errorf("%s: %s has no debug info", test.name, debugFiles[0])
+		}
+		for _, p := range []string{"/usr/bin/tool", "/" + debugFiles[0]} {
+			if sum := s.sums[p]; sum == "" || sum == "unchecked" {
+				t.Errorf("%s: md5sums of %s not updated, got %q", test.name, p, sum)
+			}
+		}
+
+		//The split debug info goes to -dbg even when a template claims all of usr/lib
+		written, err := SplitSpakg(file, "tool", spdl.Dep{Name: "tool"}, []SubPackage{debugSubPackage, {"libs", []string{"usr/lib/*"}}})
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if len(written) != 1 || !strings.Contains(written[0], "tool-dbg") {
+			t.Errorf("%s: expected only tool-dbg, got %v", test.name, written)
+		}
+	}
+}
@@ -1,12 +1,20 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"fmt"
 	"github.com/cam72cam/go-lumberjack/color"
 	"github.com/cam72cam/go-lumberjack/log"
 	"github.com/serenitylinux/libspack/argparse"
 	"github.com/serenitylinux/libspack/control"
-	"github.com/serenitylinux/libspack/forge"
+	"github.com/serenitylinux/libspack/flag"
+	"github.com/serenitylinux/libspack/helpers/json"
+	"github.com/serenitylinux/libspack/repo"
+	"github.com/serenitylinux/libspack/spakg"
+	"github.com/serenitylinux/libspack/spdl"
+	"github.com/serenitylinux/spack/resolve"
+	"github.com/serenitylinux/spack/sign"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 )
@@ -18,6 +26,18 @@ var test = false
 var output = ""
 var clean = true
 var interactive = false
+var isolate = true
+var verify = ""
+var offline = false
+var splitDebug = true
+var signKey = ""
+var signer ed25519.PrivateKey = nil
+var outdir = ""
+var allowUnsigned = false
+var requestedFlags = ""
+
+// What the package is built with, its default flags unless spack asked for others
+var buildFlags flag.FlagList = nil
 
 func arguments() string {
 
@@ -28,9 +48,17 @@ func arguments() string {
 	quietArg := argparse.RegisterBool("quiet", quiet, "")
 	testArg := argparse.RegisterBool("test", test, "")
 	cleanArg := argparse.RegisterBool("clean", clean, "Remove tmp dir used for package creation")
-	interactiveArg := argparse.RegisterBool("interactive", interactive, "Drop to shell in directory of failed build")
+	interactiveArg := argparse.RegisterBool("interactive", interactive, "Drop to shell in directory of failed build, with resume to continue from the failed phase")
+	isolateArg := argparse.RegisterBool("isolate", isolate, "Build in a fresh root containing only the Bdeps, without network access")
 
 	outputArg := argparse.RegisterString("output", "./pkgName.spakg", "")
+	splitDebugArg := argparse.RegisterBool("split-debug", splitDebug, "Strip binaries and package their debug info as <name>-dbg")
+	offlineArg := argparse.RegisterBool("offline", offline, "Fail instead of fetching sources missing from the source cache")
+	verifyArg := argparse.RegisterString("verify", "(not set)", "Rebuild and compare against an existing spakg")
+	signKeyArg := argparse.RegisterString("sign-key", "(not set)", "Sign the forged spakgs with this key, see spack keygen")
+	allowUnsignedArg := argparse.RegisterBool("allow-unsigned", allowUnsigned, "Install build deps not signed by a key in "+sign.KeysDir+" into the build root")
+	buildFlagsArg := argparse.RegisterString("flags", "(not set)", "Build with these flags instead of the defaults, in spdl form such as [+x -y]")
+	outdirArg := argparse.RegisterString("outdir", "(not set)", "Copy the forged spakgs, including sub-packages, to this directory with .control and .pkginfo sidecars")
 
 	packages := argparse.EvalDefaultArgs()
 
@@ -46,6 +74,22 @@ func arguments() string {
 	test = testArg.Get()
 	clean = cleanArg.Get()
 	interactive = interactiveArg.Get()
+	isolate = isolateArg.Get()
+	offline = offlineArg.Get()
+	splitDebug = splitDebugArg.Get()
+	allowUnsigned = allowUnsignedArg.Get()
+	if signKeyArg.IsSet() {
+		signKey, _ = filepath.Abs(signKeyArg.Get())
+	}
+	if verifyArg.IsSet() {
+		verify, _ = filepath.Abs(verifyArg.Get())
+	}
+	if outdirArg.IsSet() {
+		outdir, _ = filepath.Abs(outdirArg.Get())
+	}
+	if buildFlagsArg.IsSet() {
+		requestedFlags = buildFlagsArg.Get()
+	}
 
 	if outputArg.IsSet() {
 		output = outputArg.Get()
@@ -66,6 +110,69 @@ func arguments() string {
 	return pkgName
 }
 
+// Checks and records the forged package, returning the main spakg followed by any split from it
+func PostBuild(c *control.Control, template string, root string, isolated bool) ([]string, error) {
+	err := repo.LoadRepos()
+	if err != nil {
+		log.Warn.Format("Unable to load repos, dependency information will be incomplete: %s", err)
+	}
+
+	hasDebug := false
+	if splitDebug {
+		hasDebug, err = SplitDebug(output)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = RunQA(c, template, output, root)
+	if err != nil {
+		return nil, err
+	}
+
+	subs, err := ReadSubPackages(template)
+	if err != nil {
+		return nil, err
+	}
+	if hasDebug {
+		//The first sub-package to match a file owns it, globs like usr/lib/* must not claim the debug info
+		subs = append([]SubPackage{debugSubPackage}, subs...)
+	}
+	files := []string{output}
+	if len(subs) > 0 {
+		//-dev, -dbg etc are only usable with the exact build they were split from
+		main, err := spdl.ParseDep(fmt.Sprintf("%s::%s::%d", c.Name, c.Version, c.Iteration))
+		if err != nil {
+			return nil, err
+		}
+		split, err := SplitSpakg(output, c.Name, main, subs)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, split...)
+	}
+
+	//Only the main package carries the hooks
+	hooks, err := ReadHooks(template)
+	if err == nil && hooks != "" {
+		err = AddHooks(output, hooks)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		err = RecordBuild(c, file, root, isolated)
+		if err == nil {
+			err = SignSpakg(file, signer)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
 func main() {
 	template, err := filepath.Abs(arguments())
 	if err != nil {
@@ -73,20 +180,149 @@ func main() {
 		os.Exit(2)
 	}
 
+	if IsIsolatedChild() {
+		template, output, err = EnterIsolatedRoot()
+		if err != nil {
+			log.Error.Format("Unable to enter build root: %s", err)
+			os.Exit(2)
+		}
+	}
+
 	c, err := control.FromTemplateFile(template)
 	if err != nil {
 		log.Error.Format("Invalid package %s, %s", template, err)
 		os.Exit(2)
 	}
 
-	log.Info.Format("Forging %s in the heart of a star.", c.Name)
-	log.Warn.Println("This can be a dangerous operation, please read the instruction manual to prevent a black hole.")
-	log.Info.Println()
-	//TODO custom flags/honor globals
-	err = forge.Forge(template, output, "/", c.Flags.Defaults(), test, interactive)
+	buildFlags = c.Flags.Defaults()
+	if requestedFlags != "" {
+		buildFlags, err = resolve.ParseFlags(c.Name, requestedFlags)
+		if err != nil {
+			log.Error.Format("Invalid flags %s: %s", requestedFlags, err)
+			os.Exit(2)
+		}
+	}
+
+	if signKey != "" && !IsIsolatedChild() {
+		signer, err = sign.LoadKey(signKey)
+		if err != nil {
+			log.Error.Format("Unable to load signing key: %s", err)
+			os.Exit(2)
+		}
+	}
+
+	if verify != "" && !IsIsolatedChild() {
+		output, err = PrepareVerify(verify)
+		if err != nil {
+			log.Error.Format("Unable to verify %s: %s", verify, err)
+			os.Exit(2)
+		}
+		if clean {
+			defer os.RemoveAll(filepath.Dir(output))
+		}
+	}
+
+	sourceDateEpoch, err = SetSourceDateEpoch(template)
+	if err != nil {
+		log.Error.Format("Unable to set %s: %s", sourceDateEpochEnv, err)
+		os.Exit(2)
+	}
+
+	overlay := ""
+	if !IsIsolatedChild() {
+		sources, err := ReadSources(template)
+		if err == nil {
+			err = FetchSources(sources, offline)
+		}
+		//Interactive builds resume from the phase that failed
+		if err == nil && (len(sources) > 0 || interactive) {
+			overlay, err = OverlayTemplate(template, sources, interactive)
+			template = overlay
+		}
+		if err != nil {
+			log.Error.Println(err)
+			os.Exit(2)
+		}
+	}
+
+	var files []string
+	if isolate && !IsIsolatedChild() {
+		files, err = ForgeIsolated(c, template)
+	} else {
+		log.Info.Format("Forging %s in the heart of a star.", c.Name)
+		log.Warn.Println("This can be a dangerous operation, please read the instruction manual to prevent a black hole.")
+		log.Info.Println()
+		buildTmp := ""
+		if interactive {
+			buildTmp, err = PrepareBuildTmp()
+		}
+		if err == nil {
+			err = Build(c, template, buildTmp)
+		}
+		if buildTmp != "" && !IsIsolatedChild() {
+			FinishBuildTmp(buildTmp)
+		}
+		if err == nil && !IsIsolatedChild() {
+			files, err = PostBuild(c, template, "/", false)
+		}
+	}
+	if overlay != "" {
+		os.Remove(overlay)
+	}
 	if err != nil {
 		log.Error.Println(err)
+		os.Exit(1)
+	}
+
+	if IsIsolatedChild() {
+		return
+	}
+
+	if verify != "" {
+		err = CompareSpakgs(verify, output)
+		if err != nil {
+			log.Error.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(color.Green.String(c.Name + " verified successfully"))
+		return
+	}
+
+	if outdir != "" {
+		err = ExportSpakgs(files, outdir)
+		if err != nil {
+			log.Error.Format("Unable to export to %s: %s", outdir, err)
+			os.Exit(1)
+		}
 	}
 
 	fmt.Println(color.Green.String(c.Name + " forged successfully"))
 }
+
+// Copies each spakg into dir under its pkginfo name, along with .control and .pkginfo sidecars for indexing
+func ExportSpakgs(files []string, dir string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		arch, err := spakg.FromFile(file, nil)
+		if err != nil {
+			return fmt.Errorf("Unable to read %s: %s", file, err)
+		}
+		data, err := ioutil.ReadFile(file)
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(dir, arch.Pkginfo.String()+".spakg"), data, 0644)
+		}
+		if err == nil {
+			err = json.EncodeFile(filepath.Join(dir, arch.Control.String()+".control"), arch.Control)
+		}
+		if err == nil {
+			err = json.EncodeFile(filepath.Join(dir, arch.Pkginfo.String()+".pkginfo"), arch.Pkginfo)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+
+	"github.com/serenitylinux/libspack/misc"
+	"github.com/serenitylinux/spack/hooks"
+)
+
+// Templates declare hooks as bash functions, only their definitions are packaged
+var hookNames = []string{hooks.PreInstall, hooks.PostInstall, hooks.PreRemove, hooks.PostRemove}
+
+const readHooksScript = `source "$1" >/dev/null 2>&1
+shift
+declare -f "$@" 2>/dev/null
+true`
+
+// Returns the hook functions defined by the template as a script, or "" if it has none
+func ReadHooks(template string) (string, error) {
+	args := append([]string{"-c", readHooksScript, "bash", template}, hookNames...)
+	out, err := misc.RunCommandToString(exec.Command("bash", args...))
+	if err != nil {
+		return "", fmt.Errorf("Unable to read hooks from %s: %s", template, err)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// Adds the hooks script to the spakg at file
+func AddHooks(file string, script string) error {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	data, ok := unwrapTar(raw)
+	if !ok {
+		return fmt.Errorf("%s is not a spakg", file)
+	}
+	entries, err := readEntries(data)
+	if err != nil {
+		return err
+	}
+
+	kept := make([]tarEntry, 0, len(entries)+1)
+	for _, e := range entries {
+		if e.hdr.Name != hooks.Entry {
+			kept = append(kept, e)
+		}
+	}
+	kept = append(kept, tarEntry{&tar.Header{Name: hooks.Entry, Typeflag: tar.TypeReg, Mode: 0644}, []byte(script + "\n")})
+
+	out, err := writeEntries(kept, isGzip(raw))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, out, 0644)
+}
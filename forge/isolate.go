@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"github.com/cam72cam/go-lumberjack/log"
+	"github.com/serenitylinux/libspack/control"
+	"github.com/serenitylinux/libspack/misc"
+	"github.com/serenitylinux/spack/holds"
+	"github.com/serenitylinux/spack/resolve"
+)
+
+// Set in the environment of the re-executed forge that performs the build inside the root
+const isolatedRootEnv = "FORGE_ISOLATED_ROOT"
+const isolatedTemplateEnv = "FORGE_ISOLATED_TEMPLATE"
+const isolatedOutputEnv = "FORGE_ISOLATED_OUTPUT"
+const isolatedBuildEnv = "FORGE_ISOLATED_BUILD"
+
+// Where the template and output directories appear inside the root
+const isolatedSrc = "/forge/src"
+const isolatedOut = "/forge/out"
+
+// Build tmp of interactive builds, a host directory so it survives the root for --clean=false and keep
+const isolatedBuild = "/forge/build"
+
+func copyHolds(root string) error {
+	data, err := ioutil.ReadFile(filepath.Join("/", holds.File))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	dest := filepath.Join(root, holds.File)
+	err = os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dest, data, 0644)
+}
+
+func IsIsolatedChild() bool {
+	return os.Getenv(isolatedRootEnv) != ""
+}
+
+// Builds c in a fresh root containing only its Bdeps, by re-executing forge in new namespaces
+func ForgeIsolated(c *control.Control, template string) ([]string, error) {
+	if os.Geteuid() != 0 {
+		return nil, fmt.Errorf("Isolated builds must be run as root, use --isolate=false to build on the host")
+	}
+
+	root, err := ioutil.TempDir(os.TempDir(), "forge-root")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if clean {
+			os.RemoveAll(root)
+		} else {
+			log.Info.Format("Build root kept in %s", root)
+		}
+	}()
+
+	if len(c.Bdeps) > 0 {
+		log.Info.Format("Populating build root %s", root)
+		//spack reads pins from the root it installs into, the build deps must honor the host's
+		err = copyHolds(root)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to copy pins into the build root: %s", err)
+		}
+		args := []string{"wield", "--destdir=" + root, "--yes"}
+		if allowUnsigned {
+			args = append(args, "--allow-unsigned")
+		}
+		for _, dep := range resolve.Applicable(c.Bdeps, buildFlags) {
+			args = append(args, dep.String())
+		}
+		err = misc.RunCommandToStdOutErr(exec.Command("spack", args...))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to install build deps: %s", err)
+		}
+	} else {
+		log.Warn.Format("%s declares no build deps, the build root will be empty", c.Name)
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	env := append(os.Environ(), isolatedRootEnv+"="+root, isolatedTemplateEnv+"="+template, isolatedOutputEnv+"="+output)
+	if interactive {
+		buildTmp, err := ioutil.TempDir(os.TempDir(), "forge-build")
+		if err != nil {
+			return nil, err
+		}
+		defer FinishBuildTmp(buildTmp)
+		env = append(env, isolatedBuildEnv+"="+buildTmp)
+	}
+
+	cmd := exec.Command(self, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNET | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC,
+	}
+	err = cmd.Run()
+	if err != nil {
+		return nil, err
+	}
+	return PostBuild(c, template, root, true)
+}
+
+func bindMount(src, dest string, flags uintptr) error {
+	err := os.MkdirAll(dest, 0755)
+	if err != nil {
+		return err
+	}
+	err = syscall.Mount(src, dest, "", syscall.MS_BIND|syscall.MS_REC, "")
+	if err != nil {
+		return fmt.Errorf("Unable to bind %s: %s", src, err)
+	}
+	if flags != 0 {
+		err = syscall.Mount("", dest, "", syscall.MS_BIND|syscall.MS_REMOUNT|flags, "")
+		if err != nil {
+			return fmt.Errorf("Unable to remount %s: %s", dest, err)
+		}
+	}
+	return nil
+}
+
+// Chroots into the build root, returning the template and output paths as seen from inside it
+func EnterIsolatedRoot() (string, string, error) {
+	root := os.Getenv(isolatedRootEnv)
+	template := os.Getenv(isolatedTemplateEnv)
+	output := os.Getenv(isolatedOutputEnv)
+
+	//Keep everything below from propagating back to the host
+	err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return "", "", fmt.Errorf("Unable to make mounts private: %s", err)
+	}
+
+	mounts := []struct {
+		src   string
+		dest  string
+		flags uintptr
+	}{
+		{"/dev", "/dev", 0},
+		{"/etc/spack", "/etc/spack", syscall.MS_RDONLY},
+		{sourceCache, sourceCache, syscall.MS_RDONLY},
+		{filepath.Dir(template), isolatedSrc, syscall.MS_RDONLY},
+		{filepath.Dir(output), isolatedOut, 0},
+		{os.Getenv(isolatedBuildEnv), isolatedBuild, 0},
+	}
+	for _, m := range mounts {
+		if !misc.PathExists(m.src) {
+			continue
+		}
+		err = bindMount(m.src, root+m.dest, m.flags)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	err = os.MkdirAll(root+"/proc", 0555)
+	if err == nil {
+		err = syscall.Mount("proc", root+"/proc", "proc", 0, "")
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("Unable to mount proc: %s", err)
+	}
+
+	err = os.MkdirAll(root+"/tmp", 01777)
+	if err == nil {
+		err = syscall.Mount("tmpfs", root+"/tmp", "tmpfs", 0, "mode=1777")
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("Unable to mount tmp: %s", err)
+	}
+
+	err = syscall.Chroot(root)
+	if err != nil {
+		return "", "", err
+	}
+	err = os.Chdir("/")
+	if err != nil {
+		return "", "", err
+	}
+
+	return filepath.Join(isolatedSrc, filepath.Base(template)), filepath.Join(isolatedOut, filepath.Base(output)), nil
+}
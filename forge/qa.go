@@ -0,0 +1,505 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cam72cam/go-lumberjack/log"
+	"github.com/serenitylinux/libspack/control"
+	"github.com/serenitylinux/libspack/misc"
+	"github.com/serenitylinux/libspack/repo"
+	"github.com/serenitylinux/spack/soname"
+)
+
+const (
+	QAIgnore = "ignore"
+	QAWarn   = "warn"
+	QAFatal  = "fatal"
+)
+
+// Global QA settings, overridden by a qa.json at the top of the template's repo
+const qaConfigFile = "/etc/spack/qa.json"
+const qaRepoConfig = "qa.json"
+
+// Executables run after every build with the spakg and template as arguments
+const qaHookDir = "/etc/spack/hooks/post-build.d"
+
+const settingsFile = "/etc/spack/settings.sh"
+
+type QAConfig struct {
+	//Check name to level, hooks are named hook:<file>
+	Levels map[string]string
+	//Paths outside of PREFIX that packages may install to
+	AllowedPaths []string
+}
+
+func (conf *QAConfig) Level(check string) string {
+	if level, exists := conf.Levels[check]; exists {
+		return level
+	}
+	return QAFatal
+}
+
+func defaultQAConfig() QAConfig {
+	return QAConfig{
+		Levels: map[string]string{
+			"prefix":          QAFatal,
+			"world-writable":  QAFatal,
+			"broken-symlink":  QAWarn,
+			"missing-library": QAFatal,
+			"unstripped":      QAWarn,
+		},
+		AllowedPaths: []string{"/etc", "/var", "/boot", "/opt"},
+	}
+}
+
+func (conf *QAConfig) merge(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var override QAConfig
+	err = json.Unmarshal(data, &override)
+	if err != nil {
+		return fmt.Errorf("Invalid %s: %s", file, err)
+	}
+
+	for check, level := range override.Levels {
+		if level != QAIgnore && level != QAWarn && level != QAFatal {
+			return fmt.Errorf("Invalid level %s for %s in %s", level, check, file)
+		}
+		conf.Levels[check] = level
+	}
+	if override.AllowedPaths != nil {
+		conf.AllowedPaths = override.AllowedPaths
+	}
+	return nil
+}
+
+// The nearest qa.json above the template, stopping at the repo root
+func repoQAConfig(template string) string {
+	dir := filepath.Dir(template)
+	for {
+		file := filepath.Join(dir, qaRepoConfig)
+		if misc.PathExists(file) {
+			return file
+		}
+		if misc.PathExists(filepath.Join(dir, ".git")) || dir == "/" {
+			return ""
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func LoadQAConfig(template string) (QAConfig, error) {
+	conf := defaultQAConfig()
+	for _, file := range []string{qaConfigFile, repoQAConfig(template)} {
+		if file == "" || !misc.PathExists(file) {
+			continue
+		}
+		err := conf.merge(file)
+		if err != nil {
+			return conf, err
+		}
+	}
+	return conf, nil
+}
+
+func Prefix() string {
+	if prefix := os.Getenv("PREFIX"); prefix != "" {
+		return prefix
+	}
+
+	f, err := os.Open(settingsFile)
+	if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimPrefix(strings.TrimSpace(scanner.Text()), "export ")
+			if strings.HasPrefix(line, "PREFIX=") {
+				return strings.Trim(strings.TrimPrefix(line, "PREFIX="), "\"'")
+			}
+		}
+	}
+	return "/usr"
+}
+
+type ImageFile struct {
+	Path string
+	Hdr  *tar.Header
+	Data []byte
+}
+
+// Everything a package will install, as seen from the archives inside the spakg
+type Image struct {
+	Files map[string]*ImageFile
+	Paths []string
+}
+
+func (img *Image) add(hdr *tar.Header, data []byte) {
+	p := path.Clean("/" + hdr.Name)
+	if p == "/" {
+		return
+	}
+	if _, exists := img.Files[p]; !exists {
+		img.Paths = append(img.Paths, p)
+	}
+	img.Files[p] = &ImageFile{Path: p, Hdr: hdr, Data: data}
+}
+
+func readTar(data []byte, fn func(*tar.Header, []byte) error) error {
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		err = fn(hdr, content)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func unwrapTar(data []byte) ([]byte, bool) {
+	if isGzip(data) {
+		inner, err := gunzip(data)
+		if err != nil {
+			return nil, false
+		}
+		data = inner
+	}
+	return data, isTar(data)
+}
+
+func LoadImage(file string) (*Image, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := unwrapTar(data)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a spakg", file)
+	}
+
+	img := &Image{Files: make(map[string]*ImageFile), Paths: make([]string, 0)}
+	err = readTar(data, func(hdr *tar.Header, content []byte) error {
+		inner, ok := unwrapTar(content)
+		if !ok {
+			return nil
+		}
+		return readTar(inner, func(hdr *tar.Header, content []byte) error {
+			img.add(hdr, content)
+			return nil
+		})
+	})
+	sort.Strings(img.Paths)
+	return img, err
+}
+
+func (img *Image) ELF(f *ImageFile) *elf.File {
+	if f.Hdr.Typeflag != tar.TypeReg || len(f.Data) < 4 || string(f.Data[:4]) != elf.ELFMAG {
+		return nil
+	}
+	e, err := elf.NewFile(bytes.NewReader(f.Data))
+	if err != nil {
+		return nil
+	}
+	return e
+}
+
+type QAContext struct {
+	Control *control.Control
+	Image   *Image
+	Config  *QAConfig
+	//Root the package was built against, used to find files from deps
+	Root string
+}
+
+type QACheck struct {
+	Name string
+	Run  func(ctx *QAContext) []string
+}
+
+var qaChecks = make([]QACheck, 0)
+
+func RegisterQACheck(name string, run func(ctx *QAContext) []string) {
+	qaChecks = append(qaChecks, QACheck{Name: name, Run: run})
+}
+
+func init() {
+	RegisterQACheck("prefix", checkPrefix)
+	RegisterQACheck("world-writable", checkWorldWritable)
+	RegisterQACheck("broken-symlink", checkBrokenSymlinks)
+	RegisterQACheck("missing-library", checkMissingLibraries)
+	RegisterQACheck("unstripped", checkUnstripped)
+}
+
+func underAny(p string, dirs []string) bool {
+	for _, dir := range dirs {
+		dir = path.Clean("/" + dir)
+		if p == dir || strings.HasPrefix(p, dir+"/") || dir == "/" {
+			return true
+		}
+	}
+	return false
+}
+
+func isParentOfAny(dir string, paths []string) bool {
+	for _, p := range paths {
+		if underAny(p, []string{dir}) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkPrefix(ctx *QAContext) []string {
+	allowed := append([]string{Prefix()}, ctx.Config.AllowedPaths...)
+	problems := make([]string, 0)
+	for _, p := range ctx.Image.Paths {
+		f := ctx.Image.Files[p]
+		//Parent directories like /usr itself are fine
+		if f.Hdr.Typeflag == tar.TypeDir && isParentOfAny(p, allowed) {
+			continue
+		}
+		if !underAny(p, allowed) {
+			problems = append(problems, fmt.Sprintf("%s is outside of %s", p, Prefix()))
+		}
+	}
+	return problems
+}
+
+func checkWorldWritable(ctx *QAContext) []string {
+	problems := make([]string, 0)
+	for _, p := range ctx.Image.Paths {
+		f := ctx.Image.Files[p]
+		if f.Hdr.Typeflag == tar.TypeSymlink {
+			continue
+		}
+		mode := f.Hdr.Mode
+		//Sticky directories like /tmp are expected to be world writable
+		if f.Hdr.Typeflag == tar.TypeDir && mode&01000 != 0 {
+			continue
+		}
+		if mode&0002 != 0 {
+			problems = append(problems, fmt.Sprintf("%s is world writable (%o)", p, mode&07777))
+		}
+	}
+	return problems
+}
+
+func checkBrokenSymlinks(ctx *QAContext) []string {
+	problems := make([]string, 0)
+	for _, p := range ctx.Image.Paths {
+		f := ctx.Image.Files[p]
+		if f.Hdr.Typeflag != tar.TypeSymlink {
+			continue
+		}
+		target := f.Hdr.Linkname
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(p), target)
+		}
+		target = path.Clean(target)
+
+		if _, exists := ctx.Image.Files[target]; exists {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(ctx.Root, target)); err == nil {
+			continue
+		}
+		problems = append(problems, fmt.Sprintf("%s -> %s does not exist", p, f.Hdr.Linkname))
+	}
+	return problems
+}
+
+// Files installed by name and everything it depends on at runtime
+func depFiles(name string, root string, seen map[string]bool, files map[string]bool) {
+	if seen[name] {
+		return
+	}
+	seen[name] = true
+
+	found := false
+	for _, r := range repo.GetAllRepos() {
+		r.MapInstalledByName(root, name, func(p repo.PkgInstallSet) {
+			found = true
+			for f := range p.Hashes {
+				files[path.Clean("/"+f)] = true
+			}
+			for _, dep := range p.Control.Deps {
+				depFiles(dep.Name, root, seen, files)
+			}
+		})
+	}
+	if !found {
+		log.Warn.Format("%s is not installed in %s, its libraries cannot be checked", name, root)
+	}
+}
+
+func checkMissingLibraries(ctx *QAContext) []string {
+	provided := make(map[string]bool)
+	for _, p := range ctx.Image.Paths {
+		provided[path.Base(p)] = true
+	}
+
+	files := make(map[string]bool)
+	seen := make(map[string]bool)
+	for _, dep := range ctx.Control.Deps {
+		depFiles(dep.Name, ctx.Root, seen, files)
+	}
+	for f := range files {
+		provided[path.Base(f)] = true
+	}
+
+	problems := make([]string, 0)
+	for _, p := range ctx.Image.Paths {
+		e := ctx.Image.ELF(ctx.Image.Files[p])
+		if e == nil {
+			continue
+		}
+		needed, _ := e.ImportedLibraries()
+		for _, lib := range needed {
+			if !provided[lib] {
+				problems = append(problems, fmt.Sprintf("%s needs %s which no runtime dep provides", p, lib))
+			}
+		}
+	}
+	return problems
+}
+
+func ScanSonames(img *Image) soname.Set {
+	needed := make(map[string]bool)
+	provided := make(map[string]bool)
+	for _, p := range img.Paths {
+		e := img.ELF(img.Files[p])
+		if e == nil {
+			continue
+		}
+		libs, _ := e.ImportedLibraries()
+		for _, lib := range libs {
+			needed[lib] = true
+		}
+		if names, err := e.DynString(elf.DT_SONAME); err == nil {
+			for _, name := range names {
+				provided[name] = true
+			}
+		}
+	}
+
+	return soname.NewSet(needed, provided)
+}
+
+func checkUnstripped(ctx *QAContext) []string {
+	problems := make([]string, 0)
+	for _, p := range ctx.Image.Paths {
+		//Separate debug info is unstripped by design
+		if strings.HasPrefix(p, "/usr/lib/debug/") {
+			continue
+		}
+		e := ctx.Image.ELF(ctx.Image.Files[p])
+		if e == nil || (e.Type != elf.ET_EXEC && e.Type != elf.ET_DYN) {
+			continue
+		}
+		if e.Section(".symtab") != nil {
+			problems = append(problems, fmt.Sprintf("%s is not stripped", p))
+		}
+	}
+	return problems
+}
+
+func runQAHooks(template string, file string) map[string][]string {
+	results := make(map[string][]string)
+	hooks, _ := filepath.Glob(filepath.Join(qaHookDir, "*"))
+	sort.Strings(hooks)
+	for _, hook := range hooks {
+		stat, err := os.Stat(hook)
+		if err != nil || stat.IsDir() || stat.Mode()&0111 == 0 {
+			continue
+		}
+
+		name := "hook:" + filepath.Base(hook)
+		out, err := exec.Command(hook, file, template).CombinedOutput()
+		if err != nil {
+			msg := strings.TrimSpace(string(out))
+			if msg == "" {
+				msg = err.Error()
+			}
+			results[name] = []string{msg}
+		}
+	}
+	return results
+}
+
+// Runs every QA check and hook against the forged spakg, failing if any fatal check has problems
+func RunQA(c *control.Control, template string, file string, root string) error {
+	conf, err := LoadQAConfig(template)
+	if err != nil {
+		return err
+	}
+
+	img, err := LoadImage(file)
+	if err != nil {
+		return err
+	}
+
+	ctx := &QAContext{Control: c, Image: img, Config: &conf, Root: root}
+	results := make(map[string][]string)
+	for _, check := range qaChecks {
+		if conf.Level(check.Name) == QAIgnore {
+			continue
+		}
+		results[check.Name] = check.Run(ctx)
+	}
+	for name, problems := range runQAHooks(template, file) {
+		if conf.Level(name) != QAIgnore {
+			results[name] = problems
+		}
+	}
+
+	names := make([]string, 0)
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fatal := make([]string, 0)
+	for _, name := range names {
+		level := conf.Level(name)
+		for _, problem := range results[name] {
+			if level == QAFatal {
+				log.Error.Format("QA %s: %s", name, problem)
+			} else {
+				log.Warn.Format("QA %s: %s", name, problem)
+			}
+		}
+		if level == QAFatal && len(results[name]) > 0 {
+			fatal = append(fatal, name)
+		}
+	}
+
+	if len(fatal) > 0 {
+		return fmt.Errorf("QA checks failed: %s", strings.Join(fatal, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cam72cam/go-lumberjack/log"
+	"github.com/serenitylinux/libspack/control"
+	"github.com/serenitylinux/libspack/misc"
+	"github.com/serenitylinux/libspack/repo"
+	"github.com/serenitylinux/spack/sign"
+	"github.com/serenitylinux/spack/soname"
+)
+
+const sourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+
+var sourceDateEpoch int64
+
+// Recorded in the pkginfo of every spakg forge produces
+type BuildInfo struct {
+	SourceDateEpoch int64
+	Isolated        bool
+	Flags           interface{}
+	BuildDeps       []string
+}
+
+// Pins SOURCE_DATE_EPOCH to the template's last commit or mtime unless the caller already set it
+func SetSourceDateEpoch(template string) (int64, error) {
+	if env := os.Getenv(sourceDateEpochEnv); env != "" {
+		return strconv.ParseInt(env, 10, 64)
+	}
+
+	var epoch int64
+	cmd := exec.Command("git", "log", "-1", "--format=%ct", "--", filepath.Base(template))
+	cmd.Dir = filepath.Dir(template)
+	out, err := misc.RunCommandToString(cmd)
+	if err == nil {
+		epoch, err = strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	}
+	if err != nil {
+		stat, err := os.Stat(template)
+		if err != nil {
+			return 0, err
+		}
+		epoch = stat.ModTime().Unix()
+	}
+
+	return epoch, os.Setenv(sourceDateEpochEnv, strconv.FormatInt(epoch, 10))
+}
+
+// Versions of the build deps installed in root.  In an isolated root everything installed is a build dep.
+func InstalledBuildDeps(c *control.Control, root string, all bool) []string {
+	wanted := make(map[string]bool)
+	for _, dep := range c.Bdeps {
+		wanted[dep.Name] = true
+	}
+
+	deps := make([]string, 0)
+	for _, r := range repo.GetAllRepos() {
+		r.MapInstalled(root, func(p repo.PkgInstallSet) {
+			if all || wanted[p.Control.Name] {
+				deps = append(deps, p.PkgInfo.String())
+			}
+		})
+	}
+	sort.Strings(deps)
+	return deps
+}
+
+// Normalizes the forged spakg and records how it was built in its pkginfo
+func RecordBuild(c *control.Control, file string, root string, isolated bool) error {
+	info := BuildInfo{
+		SourceDateEpoch: sourceDateEpoch,
+		Isolated:        isolated,
+		Flags:           buildFlags,
+		BuildDeps:       InstalledBuildDeps(c, root, isolated),
+	}
+
+	img, err := LoadImage(file)
+	if err != nil {
+		return err
+	}
+
+	extra := map[string]interface{}{
+		"BuildInfo":  info,
+		soname.Field: ScanSonames(img),
+	}
+	return NormalizeSpakg(file, info.SourceDateEpoch, extra)
+}
+
+func isGzip(data []byte) bool {
+	return len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+func isTar(data []byte) bool {
+	return len(data) > 262 && string(data[257:262]) == "ustar"
+}
+
+func gunzip(data []byte) ([]byte, error) {
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+	return ioutil.ReadAll(gr)
+}
+
+func isPkgInfo(name string) bool {
+	return path.Base(name) == "pkginfo" || strings.HasSuffix(name, ".pkginfo")
+}
+
+// Rewrites a (possibly gzipped) tar with sorted entries, fixed timestamps and root ownership
+func normalizeArchive(data []byte, epoch time.Time, extra map[string]interface{}, depth int) ([]byte, error) {
+	if isGzip(data) {
+		inner, err := gunzip(data)
+		if err != nil || !isTar(inner) {
+			return data, nil
+		}
+		inner, err = normalizeArchive(inner, epoch, extra, depth)
+		if err != nil {
+			return nil, err
+		}
+
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		_, err = gw.Write(inner)
+		if err == nil {
+			err = gw.Close()
+		}
+		return buf.Bytes(), err
+	}
+
+	if !isTar(data) {
+		return data, nil
+	}
+
+	type entry struct {
+		hdr  *tar.Header
+		data []byte
+	}
+	entries := make([]entry, 0)
+
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+
+		if depth == 0 {
+			if extra != nil && isPkgInfo(hdr.Name) {
+				content, err = injectPkgInfo(content, epoch, extra)
+			} else {
+				content, err = normalizeArchive(content, epoch, nil, depth+1)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", hdr.Name, err)
+			}
+		}
+		entries = append(entries, entry{hdr, content})
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].hdr.Name < entries[j].hdr.Name })
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		e.hdr.ModTime = epoch
+		e.hdr.AccessTime = time.Time{}
+		e.hdr.ChangeTime = time.Time{}
+		e.hdr.Uid = 0
+		e.hdr.Gid = 0
+		e.hdr.Uname = "root"
+		e.hdr.Gname = "root"
+		e.hdr.Format = tar.FormatUnknown
+		for _, key := range []string{"atime", "ctime", "mtime"} {
+			delete(e.hdr.PAXRecords, key)
+		}
+		if e.hdr.Typeflag == tar.TypeReg {
+			e.hdr.Size = int64(len(e.data))
+		}
+
+		err := tw.WriteHeader(e.hdr)
+		if err == nil {
+			_, err = tw.Write(e.data)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := tw.Close()
+	return buf.Bytes(), err
+}
+
+// Adds extra top level fields to a pkginfo, libspack ignores fields it does not know
+func injectPkgInfo(content []byte, epoch time.Time, extra map[string]interface{}) ([]byte, error) {
+	var pi map[string]interface{}
+	err := json.Unmarshal(content, &pi)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, value := range extra {
+		pi[key] = value
+	}
+	//The build date would otherwise differ between every build
+	if _, exists := pi["BuildDate"]; exists {
+		pi["BuildDate"] = epoch.UTC()
+	}
+	return json.MarshalIndent(pi, "", "\t")
+}
+
+func NormalizeSpakg(file string, epoch int64, extra map[string]interface{}) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	data, err = normalizeArchive(data, time.Unix(epoch, 0), extra, 0)
+	if err != nil {
+		return fmt.Errorf("Unable to normalize %s: %s", file, err)
+	}
+
+	tmp := file + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// Maps each top level entry of a spakg to the sha256 of its contents
+func spakgEntries(file string) (map[string]string, []byte, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	archive := data
+	if isGzip(archive) {
+		archive, err = gunzip(archive)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	entries := make(map[string]string)
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, tr)
+		if err != nil {
+			return nil, nil, err
+		}
+		entries[hdr.Name] = hex.EncodeToString(h.Sum(nil))
+	}
+	return entries, data, nil
+}
+
+func ReadBuildInfo(file string) (*BuildInfo, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if isGzip(data) {
+		data, err = gunzip(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !isPkgInfo(hdr.Name) {
+			continue
+		}
+
+		var pi struct {
+			BuildInfo *BuildInfo
+		}
+		err = json.NewDecoder(tr).Decode(&pi)
+		if err != nil {
+			return nil, err
+		}
+		if pi.BuildInfo == nil {
+			break
+		}
+		return pi.BuildInfo, nil
+	}
+	return nil, fmt.Errorf("%s has no recorded build info", file)
+}
+
+// Sets up a rebuild of the spakg at file, returning where the rebuild should be written
+func PrepareVerify(file string) (string, error) {
+	info, err := ReadBuildInfo(file)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.Setenv(sourceDateEpochEnv, strconv.FormatInt(info.SourceDateEpoch, 10))
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := ioutil.TempDir(os.TempDir(), "forge-verify")
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(file)), nil
+}
+
+func CompareSpakgs(original, rebuilt string) error {
+	origEntries, origData, err := spakgEntries(original)
+	if err != nil {
+		return err
+	}
+	newEntries, newData, err := spakgEntries(rebuilt)
+	if err != nil {
+		return err
+	}
+
+	origSum := sha256.Sum256(origData)
+	newSum := sha256.Sum256(newData)
+	if origSum == newSum {
+		log.Info.Format("sha256 %s matches", hex.EncodeToString(origSum[:]))
+		return nil
+	}
+
+	//Only the signature depends on who forged it
+	delete(origEntries, sign.SignatureEntry)
+	delete(newEntries, sign.SignatureEntry)
+
+	names := make([]string, 0)
+	for name := range origEntries {
+		names = append(names, name)
+	}
+	for name := range newEntries {
+		if _, exists := origEntries[name]; !exists {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	identical := true
+	for _, name := range names {
+		if origEntries[name] != newEntries[name] {
+			log.Warn.Format("%s differs", name)
+			identical = false
+		}
+	}
+	if identical {
+		log.Info.Println("All entries match, only the signature differs")
+		return nil
+	}
+	return fmt.Errorf("Rebuild of %s is not identical (sha256 %s != %s)", original, hex.EncodeToString(origSum[:]), hex.EncodeToString(newSum[:]))
+}
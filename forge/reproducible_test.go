@@ -0,0 +1,105 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// A spakg whose entries and files come in the given order, with the given owner and times
+func testArchive(t *testing.T, order []string, uid int, mtime time.Time, compress bool) []byte {
+	fs := make([]tarEntry, 0)
+	for _, name := range order {
+		fs = append(fs, tarEntry{&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Uid: uid, Gid: uid, Uname: "builder", ModTime: mtime}, []byte(name)})
+	}
+	fsData, err := writeEntries(fs, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outer := []tarEntry{
+		{&tar.Header{Name: "pkginfo", Typeflag: tar.TypeReg, Mode: 0644, Uid: uid, ModTime: mtime}, []byte(`{"Name": "tool", "BuildDate": "` + mtime.Format(time.RFC3339) + `"}`)},
+		{&tar.Header{Name: "fs.tar.gz", Typeflag: tar.TypeReg, Mode: 0644, Uid: uid, ModTime: mtime}, fsData},
+	}
+	if order[0] != "usr/bin/a" {
+		outer[0], outer[1] = outer[1], outer[0]
+	}
+	data, err := writeEntries(outer, compress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestNormalizeArchive(t *testing.T) {
+	epoch := time.Unix(1500000000, 0)
+	extra := map[string]interface{}{"Sonames": map[string][]string{"Provided": {"libtool.so.1"}}}
+
+	tests := []struct {
+		name     string
+		compress bool
+	}{
+		{"tar", false},
+		{"gzip", true},
+	}
+
+	for _, test := range tests {
+		first := testArchive(t, []string{"usr/bin/a", "usr/bin/b"}, 1000, time.Now(), test.compress)
+		second := testArchive(t, []string{"usr/bin/b", "usr/bin/a"}, 0, time.Now().Add(time.Hour), test.compress)
+		if bytes.Equal(first, second) {
+			t.Fatalf("%s: test archives are already identical", test.name)
+		}
+
+		normalized := make([][]byte, 0)
+		for _, data := range [][]byte{first, second, first} {
+			out, err := normalizeArchive(data, epoch, extra, 0)
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+			normalized = append(normalized, out)
+		}
+		if !bytes.Equal(normalized[0], normalized[1]) || !bytes.Equal(normalized[0], normalized[2]) {
+			t.Errorf("%s: normalizing differently built archives gave different results", test.name)
+		}
+		if isGzip(normalized[0]) != test.compress {
+			t.Errorf("%s: expected compressed %t", test.name, test.compress)
+		}
+
+		data, _ := unwrapTar(normalized[0])
+		outer, err := readEntries(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(outer) != 2 || outer[0].hdr.Name != "fs.tar.gz" || outer[1].hdr.Name != "pkginfo" {
+			t.Fatalf("%s: expected sorted entries, got %v", test.name, outer)
+		}
+		for _, e := range outer {
+			if !e.hdr.ModTime.Equal(epoch) || e.hdr.Uid != 0 || e.hdr.Uname != "root" {
+				t.Errorf("%s: %s not normalized: %v %d %s", test.name, e.hdr.Name, e.hdr.ModTime, e.hdr.Uid, e.hdr.Uname)
+			}
+		}
+
+		inner, _ := unwrapTar(outer[0].data)
+		files, err := readEntries(inner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 2 || files[0].hdr.Name != "usr/bin/a" || !files[0].hdr.ModTime.Equal(epoch) || files[0].hdr.Uid != 0 {
+			t.Errorf("%s: filesystem not normalized", test.name)
+		}
+
+		var pi map[string]interface{}
+		err = json.Unmarshal(outer[1].data, &pi)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pi["Sonames"] == nil {
+			t.Errorf("%s: extra fields not added to the pkginfo", test.name)
+		}
+		if pi["BuildDate"] != epoch.UTC().Format(time.RFC3339) {
+			t.Errorf("%s: expected the build date to be the epoch, got %v", test.name, pi["BuildDate"])
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/cam72cam/go-lumberjack/log"
+	"github.com/serenitylinux/libspack/control"
+	"github.com/serenitylinux/libspack/forge"
+	"github.com/serenitylinux/libspack/misc"
+)
+
+// The template functions libspack runs in this order, each starting from the extracted sources
+var buildPhases = []string{"configure", "build", "test", "installpkg"}
+
+// Set to the directory holding the phase state of an interactive build, inside its build tmp
+const stateEnv = "FORGE_STATE_DIR"
+const stateDirName = ".forge"
+
+// Wraps the phase functions so that a resumed build skips finished phases and continues where one failed
+const phaseTemplateScript = `forge_run_phase() {
+	local phase=$1
+	shift
+	[ -f "$FORGE_STATE_DIR/$phase.done" ] && return 0
+	if [ -f "$FORGE_STATE_DIR/resume" ]; then
+		cd "$(cat "$FORGE_STATE_DIR/dir")" || return
+	fi
+	echo "$phase" > "$FORGE_STATE_DIR/phase"
+	pwd > "$FORGE_STATE_DIR/dir"
+	{ declare -p; declare -f; } > "$FORGE_STATE_DIR/env" 2>/dev/null
+	"forge_template_$phase" "$@" || return
+	touch "$FORGE_STATE_DIR/$phase.done"
+}
+for forge_phase in %s; do
+	if declare -f "$forge_phase" >/dev/null; then
+		eval "forge_template_$(declare -f "$forge_phase")"
+		eval "$forge_phase() { forge_run_phase $forge_phase \"\$@\"; }"
+	elif [ -f "$FORGE_STATE_DIR/$forge_phase.done" ]; then
+		eval "$forge_phase() { :; }"
+	fi
+done
+unset forge_phase
+`
+
+// Loaded by the failure shell, the build environment is the one the failed phase started with
+const failureShellRc = `[ -f /etc/spack/settings.sh ] && source /etc/spack/settings.sh
+[ -f "$FORGE_STATE_DIR/env" ] && source "$FORGE_STATE_DIR/env" 2>/dev/null
+resume() { touch "$FORGE_STATE_DIR/resume"; exit 0; }
+keep() { touch "$FORGE_STATE_DIR/keep"; echo "Build directory will be kept"; }
+PS1="(forge $FORGE_PKG) \w \$ "
+echo "Build of $FORGE_PKG failed, you are in its build directory."
+echo "  resume   %s"
+echo "  keep     keep the build directory afterwards"
+echo "  exit     give up"
+`
+
+// Gives the build its own TMPDIR so that the directory of a failed build can be found
+func PrepareBuildTmp() (string, error) {
+	dir := isolatedBuild
+	if !IsIsolatedChild() {
+		var err error
+		dir, err = ioutil.TempDir(os.TempDir(), "forge-build")
+		if err != nil {
+			return "", err
+		}
+	}
+	err := os.MkdirAll(filepath.Join(dir, stateDirName), 0755)
+	if err != nil {
+		return "", err
+	}
+	return dir, os.Setenv("TMPDIR", dir)
+}
+
+// Removes the build tmp unless the build was run with --clean=false or keep was used in the failure shell
+func FinishBuildTmp(dir string) {
+	if !clean || misc.PathExists(filepath.Join(dir, stateDirName, "keep")) {
+		log.Info.Format("Build directory kept in %s", dir)
+		return
+	}
+	os.RemoveAll(dir)
+}
+
+// The most recently modified directory in dir, or dir itself if there is none
+func newestDir(dir string) string {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return dir
+	}
+	newest := dir
+	var newestInfo os.FileInfo
+	for _, info := range infos {
+		if info.IsDir() && !strings.HasPrefix(info.Name(), ".") && (newestInfo == nil || info.ModTime().After(newestInfo.ModTime())) {
+			newest = filepath.Join(dir, info.Name())
+			newestInfo = info
+		}
+	}
+	return newest
+}
+
+// The phase the last build attempt failed in, or "" if it failed outside of the template's phases
+func failedPhase(stateDir string) string {
+	data, err := ioutil.ReadFile(filepath.Join(stateDir, "phase"))
+	if err != nil {
+		return ""
+	}
+	phase := strings.TrimSpace(string(data))
+	if misc.PathExists(filepath.Join(stateDir, phase+".done")) {
+		return ""
+	}
+	return phase
+}
+
+// Forgets every phase so that the next attempt starts over
+func resetPhases(stateDir string) {
+	for _, name := range []string{"phase", "dir", "env", "resume"} {
+		os.Remove(filepath.Join(stateDir, name))
+	}
+	for _, phase := range buildPhases {
+		os.Remove(filepath.Join(stateDir, phase+".done"))
+	}
+}
+
+// Marks the phases before phase done, including ones libspack runs by default, so that the next attempt starts at phase
+func resumeAt(stateDir string, phase string) {
+	for _, p := range buildPhases {
+		if p == phase {
+			break
+		}
+		ioutil.WriteFile(filepath.Join(stateDir, p+".done"), nil, 0644)
+	}
+}
+
+// Drops to a shell in the failed build's directory, returning whether the user asked to resume
+func FailureShell(c *control.Control, buildTmp string, phase string) bool {
+	stateDir := filepath.Join(buildTmp, stateDirName)
+	resumeHelp := "rebuild from the start with your changes"
+	dir := newestDir(buildTmp)
+	if phase != "" {
+		resumeHelp = "continue the build from the failed " + phase + " phase"
+		if data, err := ioutil.ReadFile(filepath.Join(stateDir, "dir")); err == nil && misc.PathExists(strings.TrimSpace(string(data))) {
+			dir = strings.TrimSpace(string(data))
+		}
+	}
+
+	rc := filepath.Join(stateDir, "rc")
+	err := ioutil.WriteFile(rc, []byte(fmt.Sprintf(failureShellRc, resumeHelp)), 0644)
+	if err != nil {
+		log.Error.Format("Unable to start shell: %s", err)
+		return false
+	}
+	defer os.Remove(rc)
+
+	cmd := exec.Command("bash", "--rcfile", rc, "-i")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), stateEnv+"="+stateDir, "FORGE_PKG="+c.Name)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Run()
+
+	return misc.PathExists(filepath.Join(stateDir, "resume"))
+}
+
+// Forges the template, dropping to a failure shell in buildTmp on error when interactive
+func Build(c *control.Control, template string, buildTmp string) error {
+	if !interactive {
+		return forge.Forge(template, output, "/", buildFlags, test, false)
+	}
+
+	stateDir := filepath.Join(buildTmp, stateDirName)
+	err := os.Setenv(stateEnv, stateDir)
+	if err != nil {
+		return err
+	}
+
+	for {
+		err = forge.Forge(template, output, "/", buildFlags, test, false)
+		if err == nil {
+			return nil
+		}
+		log.Error.Println(err)
+
+		phase := failedPhase(stateDir)
+		os.Remove(filepath.Join(stateDir, "resume"))
+		if !FailureShell(c, buildTmp, phase) {
+			return err
+		}
+
+		if phase == "" {
+			resetPhases(stateDir)
+			log.Info.Format("Rebuilding %s", c.Name)
+		} else {
+			resumeAt(stateDir, phase)
+			log.Info.Format("Resuming %s from %s", c.Name, phase)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/ed25519"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/serenitylinux/spack/sign"
+)
+
+// Adds the manifest to the spakg at file, and its signature if key is set
+func SignSpakg(file string, key ed25519.PrivateKey) error {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	data, ok := unwrapTar(raw)
+	if !ok {
+		return fmt.Errorf("%s is not a spakg", file)
+	}
+	entries, err := readEntries(data)
+	if err != nil {
+		return err
+	}
+
+	kept := make([]tarEntry, 0, len(entries)+2)
+	contents := make(map[string][]byte)
+	for _, e := range entries {
+		if e.hdr.Name == sign.ManifestEntry || e.hdr.Name == sign.SignatureEntry {
+			continue
+		}
+		kept = append(kept, e)
+		if e.hdr.Typeflag == tar.TypeReg {
+			contents[e.hdr.Name] = e.data
+		}
+	}
+
+	manifest := sign.Manifest(contents)
+	added := map[string][]byte{sign.ManifestEntry: manifest}
+	if key != nil {
+		added[sign.SignatureEntry] = sign.Signature(key, manifest)
+	}
+	for name, content := range added {
+		kept = append(kept, tarEntry{&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			ModTime:  time.Unix(sourceDateEpoch, 0),
+			Uname:    "root",
+			Gname:    "root",
+		}, content})
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].hdr.Name < kept[j].hdr.Name })
+
+	out, err := writeEntries(kept, isGzip(raw))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, out, 0644)
+}
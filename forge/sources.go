@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/cam72cam/go-lumberjack/log"
+	"github.com/serenitylinux/libspack/misc"
+	"github.com/serenitylinux/spack/pie"
+)
+
+const sourceCache = "/var/cache/spack/sources"
+
+// Templates list one sha256sums entry per src entry, in the same order
+const readSourcesScript = `source "$1" >/dev/null 2>&1
+for s in "${src[@]}"; do echo "src $s"; done
+for s in "${sha256sums[@]}"; do echo "sum $s"; done`
+
+type Source struct {
+	Url    string
+	Sha256 string
+	//Set for files shipped with the template, such as patches, which are used in place
+	Local string
+}
+
+func (s Source) IsVCS() bool {
+	return pie.IsVCSSource(s.Url)
+}
+
+func (s Source) CachePath() string {
+	if s.Local != "" {
+		return s.Local
+	}
+	return filepath.Join(sourceCache, s.Sha256, path.Base(s.Url))
+}
+
+// The file a source without a scheme or with file:// refers to, relative to the template's directory
+func localSource(url string, dir string) string {
+	p := strings.TrimPrefix(url, "file://")
+	if strings.Contains(p, "://") {
+		return ""
+	}
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(dir, p)
+	}
+	return p
+}
+
+func ReadSources(template string) ([]Source, error) {
+	out, err := misc.RunCommandToString(exec.Command("bash", "-c", readSourcesScript, "bash", template))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read sources from %s: %s", template, err)
+	}
+
+	urls := make([]string, 0)
+	sums := make([]string, 0)
+	for _, line := range strings.Split(out, "\n") {
+		switch {
+		case strings.HasPrefix(line, "src "):
+			urls = append(urls, strings.TrimPrefix(line, "src "))
+		case strings.HasPrefix(line, "sum "):
+			sums = append(sums, strings.ToLower(strings.TrimPrefix(line, "sum ")))
+		}
+	}
+
+	if len(sums) != len(urls) {
+		return nil, fmt.Errorf("%s declares %d sources but %d sha256sums", template, len(urls), len(sums))
+	}
+
+	sources := make([]Source, len(urls))
+	for i := range urls {
+		sources[i] = Source{Url: urls[i], Sha256: sums[i]}
+		if !sources[i].IsVCS() {
+			sources[i].Local = localSource(urls[i], filepath.Dir(template))
+		}
+		if sources[i].Sha256 == strings.ToLower(pie.SkipChecksum) {
+			if !sources[i].IsVCS() {
+				return nil, fmt.Errorf("%s must have a checksum", urls[i])
+			}
+			sources[i].Sha256 = pie.SkipChecksum
+		}
+	}
+	return sources, nil
+}
+
+func fileSha256(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	return hex.EncodeToString(h.Sum(nil)), err
+}
+
+func download(src Source) error {
+	dest := src.CachePath()
+	err := os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(src.Url, "http://") && !strings.HasPrefix(src.Url, "https://") {
+		return fmt.Errorf("Unable to fetch %s: only http(s), VCS and local sources are supported", src.Url)
+	}
+
+	log.Info.Format("Fetching %s", src.Url)
+	resp, err := http.Get(src.Url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unable to fetch %s: %s", src.Url, resp.Status)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), ".fetch")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), resp.Body)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	if sum != src.Sha256 {
+		return fmt.Errorf("Checksum mismatch for %s: expected %s, got %s", src.Url, src.Sha256, sum)
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+// Makes sure every source is in the cache with the right checksum
+func FetchSources(sources []Source, offline bool) error {
+	for _, src := range sources {
+		if src.IsVCS() {
+			if offline {
+				return fmt.Errorf("%s is a VCS source and cannot be built offline", src.Url)
+			}
+			log.Warn.Format("%s is a VCS source and will not be cached", src.Url)
+			continue
+		}
+
+		dest := src.CachePath()
+		if src.Local != "" {
+			sum, err := fileSha256(dest)
+			if err != nil {
+				return fmt.Errorf("Unable to read local source %s: %s", src.Url, err)
+			}
+			if sum != src.Sha256 {
+				return fmt.Errorf("Checksum mismatch for %s: expected %s, got %s", src.Url, src.Sha256, sum)
+			}
+			continue
+		}
+		if misc.PathExists(dest) {
+			sum, err := fileSha256(dest)
+			if err != nil {
+				return err
+			}
+			if sum == src.Sha256 {
+				log.Debug.Format("Using cached %s", dest)
+				continue
+			}
+			log.Warn.Format("Removing corrupt cached %s", dest)
+			os.Remove(dest)
+		}
+
+		if offline {
+			return fmt.Errorf("%s is not cached (sha256 %s)", src.Url, src.Sha256)
+		}
+
+		err := download(src)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes a template beside the original that builds from the fetched sources, tracking phases if asked
+func OverlayTemplate(template string, sources []Source, phased bool) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "source \"$(dirname \"${BASH_SOURCE[0]}\")/%s\"\n", filepath.Base(template))
+	if len(sources) > 0 {
+		b.WriteString("src=(")
+		for _, src := range sources {
+			url := src.Url
+			if !src.IsVCS() {
+				url = src.CachePath()
+			}
+			fmt.Fprintf(&b, " '%s'", strings.Replace(url, "'", `'\''`, -1))
+		}
+		b.WriteString(" )\n")
+	}
+	if phased {
+		fmt.Fprintf(&b, phaseTemplateScript, strings.Join(buildPhases, " "))
+	}
+
+	overlay := filepath.Join(filepath.Dir(template), "."+filepath.Base(template)+".forge")
+	return overlay, ioutil.WriteFile(overlay, []byte(b.String()), 0644)
+}
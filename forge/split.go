@@ -0,0 +1,334 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/cam72cam/go-lumberjack/log"
+	"github.com/serenitylinux/libspack/misc"
+	"github.com/serenitylinux/libspack/spdl"
+)
+
+// Templates declare sub-packages as
+//
+//	subpackages=(dev doc)
+//	subpkg_dev=('usr/include/*' 'usr/lib/*.a')
+//
+// and each one is forged as <name>-<suffix> containing the matching files
+const readSubPackagesScript = `source "$1" >/dev/null 2>&1
+for s in "${subpackages[@]}"; do
+	if [[ ! $s =~ ^[a-z0-9]+$ ]]; then echo "bad $s"; continue; fi
+	eval 'for g in "${subpkg_'"$s"'[@]}"; do echo "glob $s $g"; done'
+	echo "sub $s"
+done`
+
+var subSuffixRgx = regexp.MustCompile("^[a-z0-9]+$")
+
+type SubPackage struct {
+	Suffix string
+	Globs  []string
+}
+
+func ReadSubPackages(template string) ([]SubPackage, error) {
+	out, err := misc.RunCommandToString(exec.Command("bash", "-c", readSubPackagesScript, "bash", template))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read subpackages from %s: %s", template, err)
+	}
+
+	subs := make([]SubPackage, 0)
+	globs := make(map[string][]string)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.SplitN(line, " ", 3)
+		switch {
+		case fields[0] == "bad" && len(fields) > 1:
+			return nil, fmt.Errorf("Invalid subpackage name %s, must match %s", fields[1], subSuffixRgx)
+		case fields[0] == "glob" && len(fields) == 3:
+			globs[fields[1]] = append(globs[fields[1]], strings.TrimPrefix(fields[2], "/"))
+		case fields[0] == "sub" && len(fields) == 2:
+			if len(globs[fields[1]]) == 0 {
+				return nil, fmt.Errorf("Subpackage %s has no files declared in subpkg_%s", fields[1], fields[1])
+			}
+			subs = append(subs, SubPackage{Suffix: fields[1], Globs: globs[fields[1]]})
+		}
+	}
+	return subs, nil
+}
+
+// A file belongs to a sub-package if it, or any directory above it, matches one of the globs
+func (sub SubPackage) Matches(p string) bool {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	for p != "." && p != "" {
+		for _, glob := range sub.Globs {
+			if ok, _ := path.Match(glob, p); ok {
+				return true
+			}
+		}
+		p = path.Dir(p)
+	}
+	return false
+}
+
+func SubPackageName(name string, sub SubPackage) string {
+	return name + "-" + sub.Suffix
+}
+
+// Where a sub-package is written, based on the main package's output
+func SubPackageOutput(file string, name string, sub SubPackage) string {
+	base := filepath.Base(file)
+	if strings.Contains(base, name) {
+		base = strings.Replace(base, name, SubPackageName(name, sub), 1)
+	} else {
+		ext := filepath.Ext(base)
+		base = strings.TrimSuffix(base, ext) + "-" + sub.Suffix + ext
+	}
+	return filepath.Join(filepath.Dir(file), base)
+}
+
+type tarEntry struct {
+	hdr  *tar.Header
+	data []byte
+}
+
+func readEntries(data []byte) ([]tarEntry, error) {
+	entries := make([]tarEntry, 0)
+	err := readTar(data, func(hdr *tar.Header, content []byte) error {
+		entries = append(entries, tarEntry{hdr, content})
+		return nil
+	})
+	return entries, err
+}
+
+func writeEntries(entries []tarEntry, compress bool) ([]byte, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := *e.hdr
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(e.data))
+		}
+		err := tw.WriteHeader(&hdr)
+		if err == nil {
+			_, err = tw.Write(e.data)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := tw.Close()
+	if err != nil || !compress {
+		return buf.Bytes(), err
+	}
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, err = gw.Write(buf.Bytes())
+	if err == nil {
+		err = gw.Close()
+	}
+	return gz.Bytes(), err
+}
+
+// Overrides fields of a control or pkginfo entry, leaving the rest as forged
+func setJSONFields(content []byte, fields map[string]interface{}) ([]byte, error) {
+	var obj map[string]interface{}
+	err := json.Unmarshal(content, &obj)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range fields {
+		obj[key] = value
+	}
+	return json.MarshalIndent(obj, "", "\t")
+}
+
+// Restricts a path keyed md5sums entry to the files in keep, leaving other formats alone
+func filterSums(content []byte, keep map[string]bool) []byte {
+	var sums map[string]interface{}
+	if json.Unmarshal(content, &sums) != nil {
+		return content
+	}
+	for f := range sums {
+		if !keep[path.Clean("/"+f)] {
+			delete(sums, f)
+		}
+	}
+	filtered, err := json.MarshalIndent(sums, "", "\t")
+	if err != nil {
+		return content
+	}
+	return filtered
+}
+
+func isControl(name string) bool {
+	return path.Base(name) == "control" || strings.HasSuffix(name, ".control")
+}
+
+func isSharedObject(p string) bool {
+	base := path.Base(p)
+	return strings.HasSuffix(base, ".so") || strings.Contains(base, ".so.")
+}
+
+// Splits each sub-package out of the spakg at file, returning the sub-package spakgs written.
+// Sub-packages depend on the exact main, except those with shared libraries which main depends on instead.
+func SplitSpakg(file string, name string, main spdl.Dep, subs []SubPackage) ([]string, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	outerCompressed := isGzip(raw)
+	outerData, ok := unwrapTar(raw)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a spakg", file)
+	}
+	outer, err := readEntries(outerData)
+	if err != nil {
+		return nil, err
+	}
+
+	//Index 0 is the main package, sub-packages follow in declaration order
+	owner := func(p string) int {
+		for i, sub := range subs {
+			if sub.Matches(p) {
+				return i + 1
+			}
+		}
+		return 0
+	}
+
+	type pkg struct {
+		name  string
+		file  string
+		files map[string]bool
+		outer []tarEntry
+	}
+	pkgs := []*pkg{{name: name, file: file, files: make(map[string]bool)}}
+	for _, sub := range subs {
+		pkgs = append(pkgs, &pkg{name: SubPackageName(name, sub), file: SubPackageOutput(file, name, sub), files: make(map[string]bool)})
+	}
+
+	//First pass to find which files each package owns so md5sums can be filtered
+	fsEntries := make(map[int][]tarEntry)
+	for i, e := range outer {
+		inner, ok := unwrapTar(e.data)
+		if !ok {
+			continue
+		}
+		entries, err := readEntries(inner)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", e.hdr.Name, err)
+		}
+		fsEntries[i] = entries
+		for _, fe := range entries {
+			if fe.hdr.Typeflag != tar.TypeDir {
+				pkgs[owner(fe.hdr.Name)].files[path.Clean("/"+fe.hdr.Name)] = true
+			}
+		}
+	}
+
+	//The -dbg package's split debug info is no shared library main needs
+	libs := make(map[int]bool)
+	libDeps := make([]spdl.Dep, 0)
+	for idx, p := range pkgs[1:] {
+		if len(p.files) == 0 {
+			log.Warn.Format("Subpackage %s matches no files", p.name)
+		}
+		for f := range p.files {
+			if isSharedObject(f) && !strings.HasPrefix(f, "/"+debugDir+"/") {
+				libs[idx+1] = true
+				dep := main
+				dep.Name = p.name
+				libDeps = append(libDeps, dep)
+				break
+			}
+		}
+	}
+
+	for i, e := range outer {
+		for idx, p := range pkgs {
+			content := e.data
+			var err error
+			switch {
+			case fsEntries[i] != nil:
+				kept := make([]tarEntry, 0)
+				for _, fe := range fsEntries[i] {
+					fp := path.Clean("/" + fe.hdr.Name)
+					if fe.hdr.Typeflag == tar.TypeDir {
+						//Keep directories in the main package unless a sub-package claims them, and parents of owned files elsewhere
+						needed := idx == 0 && owner(fe.hdr.Name) == 0
+						for f := range p.files {
+							needed = needed || strings.HasPrefix(f, fp+"/")
+						}
+						if needed {
+							kept = append(kept, fe)
+						}
+					} else if p.files[fp] {
+						kept = append(kept, fe)
+					}
+				}
+				content, err = writeEntries(kept, isGzip(e.data))
+			case idx > 0 && isPkgInfo(e.hdr.Name):
+				content, err = setJSONFields(e.data, map[string]interface{}{"Name": p.name})
+			case isControl(e.hdr.Name):
+				content, err = splitControl(e.data, p.name, idx, main, libs[idx], libDeps)
+			case path.Base(e.hdr.Name) == "md5sums":
+				content = filterSums(e.data, p.files)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", e.hdr.Name, err)
+			}
+			p.outer = append(p.outer, tarEntry{e.hdr, content})
+		}
+	}
+
+	written := make([]string, 0)
+	for idx, p := range pkgs {
+		if idx > 0 && len(p.files) == 0 {
+			continue
+		}
+		data, err := writeEntries(p.outer, outerCompressed)
+		if err == nil {
+			err = ioutil.WriteFile(p.file, data, 0644)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if idx > 0 {
+			log.Info.Format("Split %s into %s", p.name, p.file)
+			written = append(written, p.file)
+		}
+	}
+	return written, nil
+}
+
+// The control of package idx of a split, 0 being main
+func splitControl(content []byte, name string, idx int, main spdl.Dep, lib bool, libDeps []spdl.Dep) ([]byte, error) {
+	var c struct {
+		Deps []spdl.Dep
+	}
+	err := json.Unmarshal(content, &c)
+	if err != nil {
+		return nil, err
+	}
+	if c.Deps == nil {
+		c.Deps = []spdl.Dep{}
+	}
+	switch {
+	case idx == 0 && len(libDeps) > 0:
+		return setJSONFields(content, map[string]interface{}{"Deps": append(c.Deps, libDeps...)})
+	case idx == 0:
+		return content, nil
+	case lib:
+		return setJSONFields(content, map[string]interface{}{"Name": name, "Deps": c.Deps})
+	default:
+		return setJSONFields(content, map[string]interface{}{"Name": name, "Deps": []spdl.Dep{main}})
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/serenitylinux/libspack/spdl"
+)
+
+// Writes a spakg laid out like forge's output in dir, with files as its filesystem
+func writeTestSpakg(t *testing.T, dir string, files map[string][]byte) string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fs := make([]tarEntry, 0)
+	dirs := make(map[string]bool)
+	sums := make(map[string]string)
+	for _, name := range names {
+		for dir := path.Dir(name); dir != "." && !dirs[dir]; dir = path.Dir(dir) {
+			dirs[dir] = true
+			fs = append(fs, tarEntry{&tar.Header{Name: "./" + dir + "/", Typeflag: tar.TypeDir, Mode: 0755}, nil})
+		}
+		fs = append(fs, tarEntry{&tar.Header{Name: "./" + name, Typeflag: tar.TypeReg, Mode: 0755}, files[name]})
+		sums["/"+name] = "unchecked"
+	}
+	fsData, err := writeEntries(fs, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sumsData, _ := json.Marshal(sums)
+
+	outer := []tarEntry{
+		{&tar.Header{Name: "control", Typeflag: tar.TypeReg, Mode: 0644}, []byte(`{"Name": "tool", "Version": "1.0", "Iteration": 1, "Deps": []}`)},
+		{&tar.Header{Name: "pkginfo", Typeflag: tar.TypeReg, Mode: 0644}, []byte(`{"Name": "tool", "Version": "1.0", "Iteration": 1}`)},
+		{&tar.Header{Name: "md5sums", Typeflag: tar.TypeReg, Mode: 0644}, sumsData},
+		{&tar.Header{Name: "fs.tar.gz", Typeflag: tar.TypeReg, Mode: 0644}, fsData},
+	}
+	data, err := writeEntries(outer, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "tool-1.0-1.spakg")
+	err = ioutil.WriteFile(file, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+type testSpakg struct {
+	control map[string]interface{}
+	sums    map[string]string
+	//Regular files of the filesystem
+	files map[string][]byte
+}
+
+func readTestSpakg(t *testing.T, file string) testSpakg {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, ok := unwrapTar(raw)
+	if !ok {
+		t.Fatalf("%s is not a spakg", file)
+	}
+	outer, err := readEntries(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := testSpakg{files: make(map[string][]byte)}
+	for _, e := range outer {
+		switch e.hdr.Name {
+		case "control":
+			err = json.Unmarshal(e.data, &s.control)
+		case "md5sums":
+			err = json.Unmarshal(e.data, &s.sums)
+		case "fs.tar.gz":
+			inner, _ := unwrapTar(e.data)
+			var entries []tarEntry
+			entries, err = readEntries(inner)
+			for _, fe := range entries {
+				if fe.hdr.Typeflag == tar.TypeReg {
+					s.files[strings.TrimPrefix(fe.hdr.Name, "./")] = fe.data
+				}
+			}
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", e.hdr.Name, err)
+		}
+	}
+	return s
+}
+
+func (s testSpakg) paths() []string {
+	paths := make([]string, 0, len(s.files))
+	for p := range s.files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (s testSpakg) depNames() []string {
+	names := make([]string, 0)
+	deps, _ := s.control["Deps"].([]interface{})
+	for _, dep := range deps {
+		if m, ok := dep.(map[string]interface{}); ok {
+			names = append(names, m["Name"].(string))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestReadSubPackages(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		expected []SubPackage
+		err      string
+	}{
+		{"none", "name=tool\n", []SubPackage{}, ""},
+		{
+			"declared",
+			"subpackages=(dev doc)\nsubpkg_dev=('usr/include/*' '/usr/lib/*.a')\nsubpkg_doc=('usr/share/doc')\n",
+			[]SubPackage{{"dev", []string{"usr/include/*", "usr/lib/*.a"}}, {"doc", []string{"usr/share/doc"}}},
+			"",
+		},
+		{"bad name", "subpackages=('Dev')\nsubpkg_Dev=('usr/include/*')\n", nil, "Invalid subpackage name Dev"},
+		{"no globs", "subpackages=(dev)\n", nil, "Subpackage dev has no files"},
+	}
+
+	dir, err := ioutil.TempDir("", "forge-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range tests {
+		template := filepath.Join(dir, strings.Replace(test.name, " ", "-", -1)+".pie")
+		err := ioutil.WriteFile(template, []byte(test.template), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		subs, err := ReadSubPackages(template)
+		switch {
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		case test.err == "" && err != nil:
+			t.Errorf("%s: %s", test.name, err)
+		case test.err == "" && !reflect.DeepEqual(subs, test.expected):
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, subs)
+		}
+	}
+}
+
+func TestSubPackageMatches(t *testing.T) {
+	tests := []struct {
+		globs    []string
+		path     string
+		expected bool
+	}{
+		{[]string{"usr/include/*"}, "usr/include/tool.h", true},
+		{[]string{"usr/include/*"}, "/usr/include/tool/sub.h", true},
+		{[]string{"usr/include/*"}, "usr/lib/libtool.so", false},
+		{[]string{"usr/share/doc"}, "usr/share/doc/tool/README", true},
+		{[]string{"usr/lib/*.a"}, "usr/lib/libtool.a", true},
+		{[]string{"usr/lib/*.a"}, "usr/lib/libtool.so", false},
+	}
+	for _, test := range tests {
+		sub := SubPackage{Suffix: "test", Globs: test.globs}
+		if sub.Matches(test.path) != test.expected {
+			t.Errorf("%v matching %s: expected %t", test.globs, test.path, test.expected)
+		}
+	}
+}
+
+func TestSplitSpakg(t *testing.T) {
+	files := map[string][]byte{
+		"usr/bin/tool":                 []byte("binary"),
+		"usr/include/tool.h":           []byte("header"),
+		"usr/lib/libtool.so.1":         []byte("library"),
+		"usr/lib/libtool.a":            []byte("archive"),
+		"usr/lib/debug/usr/bin/tool.d": []byte("debug"),
+		"usr/share/doc/tool/README":    []byte("readme"),
+	}
+
+	tests := []struct {
+		name string
+		subs []SubPackage
+		//Files of each package by name, main included
+		expected map[string][]string
+		//Deps of each package by name
+		deps map[string][]string
+	}{
+		{
+			"no sub-packages",
+			nil,
+			map[string][]string{"tool": {"usr/bin/tool", "usr/include/tool.h", "usr/lib/debug/usr/bin/tool.d", "usr/lib/libtool.a", "usr/lib/libtool.so.1", "usr/share/doc/tool/README"}},
+			map[string][]string{"tool": {}},
+		},
+		{
+			"dev and doc",
+			[]SubPackage{{"dev", []string{"usr/include/*", "usr/lib/*.a"}}, {"doc", []string{"usr/share/doc"}}},
+			map[string][]string{
+				"tool":     {"usr/bin/tool", "usr/lib/debug/usr/bin/tool.d", "usr/lib/libtool.so.1"},
+				"tool-dev": {"usr/include/tool.h", "usr/lib/libtool.a"},
+				"tool-doc": {"usr/share/doc/tool/README"},
+			},
+			map[string][]string{"tool": {}, "tool-dev": {"tool"}, "tool-doc": {"tool"}},
+		},
+		{
+			"libs and dbg",
+			[]SubPackage{debugSubPackage, {"libs", []string{"usr/lib/*"}}},
+			map[string][]string{
+				"tool":      {"usr/bin/tool", "usr/include/tool.h", "usr/share/doc/tool/README"},
+				"tool-dbg":  {"usr/lib/debug/usr/bin/tool.d"},
+				"tool-libs": {"usr/lib/libtool.a", "usr/lib/libtool.so.1"},
+			},
+			map[string][]string{"tool": {"tool-libs"}, "tool-dbg": {"tool"}, "tool-libs": {}},
+		},
+	}
+
+	main := spdl.Dep{Name: "tool"}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "forge-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		file := writeTestSpakg(t, dir, files)
+		written, err := SplitSpakg(file, "tool", main, test.subs)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if len(written) != len(test.expected)-1 {
+			t.Errorf("%s: expected %d sub-packages, got %v", test.name, len(test.expected)-1, written)
+		}
+
+		for name, expected := range test.expected {
+			s := readTestSpakg(t, filepath.Join(dir, strings.Replace(filepath.Base(file), "tool", name, 1)))
+			if paths := s.paths(); !reflect.DeepEqual(paths, expected) {
+				t.Errorf("%s: expected %s to contain %v, got %v", test.name, name, expected, paths)
+			}
+			if s.control["Name"] != name {
+				t.Errorf("%s: expected control of %s, got %v", test.name, name, s.control["Name"])
+			}
+			if deps := s.depNames(); !reflect.DeepEqual(deps, test.deps[name]) {
+				t.Errorf("%s: expected %s to depend on %v, got %v", test.name, name, test.deps[name], deps)
+			}
+			if len(s.sums) != len(expected) {
+				t.Errorf("%s: expected md5sums of %s to list %d files, got %v", test.name, name, len(expected), s.sums)
+			}
+		}
+	}
+}
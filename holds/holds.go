@@ -0,0 +1,59 @@
+// Packages the admin has held or pinned, kept by spack and copied into isolated roots by forge.
+package holds
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cam72cam/go-lumberjack/log"
+)
+
+// Relative to the root
+const File = "var/lib/spack/holds.json"
+
+type Holds struct {
+	Held   []string
+	Pinned map[string]string
+}
+
+func Load(root string) Holds {
+	h := Holds{Held: make([]string, 0), Pinned: make(map[string]string)}
+	data, err := ioutil.ReadFile(filepath.Join(root, File))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn.Format("Unable to read holds: %s", err)
+		}
+		return h
+	}
+	err = json.Unmarshal(data, &h)
+	if err != nil {
+		log.Warn.Format("Ignoring invalid holds: %s", err)
+	}
+	if h.Pinned == nil {
+		h.Pinned = make(map[string]string)
+	}
+	return h
+}
+
+func (h Holds) Save(root string) error {
+	file := filepath.Join(root, File)
+	data, err := json.MarshalIndent(h, "", "\t")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(file), 0755)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(file, data, 0644)
+	}
+	return err
+}
+
+func (h Holds) IsHeld(name string) bool {
+	for _, held := range h.Held {
+		if held == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,186 @@
+// Install and remove hooks of packages, shared by wield and spack so that both run them the same way.
+package hooks
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cam72cam/go-lumberjack/log"
+)
+
+// Spakg entry holding the package's hook functions
+const Entry = "hooks"
+
+const Dir = "/var/lib/spack/hooks"
+const Log = "/var/log/spack/hooks.log"
+
+const (
+	PreInstall  = "pre_install"
+	PostInstall = "post_install"
+	PreRemove   = "pre_remove"
+	PostRemove  = "post_remove"
+)
+
+func Path(name string) string {
+	return filepath.Join(Dir, name+".sh")
+}
+
+// Keeps the hooks of name for later phases, a nil script drops hooks left by a previous version
+func Store(destdir string, name string, script []byte) error {
+	p := filepath.Join(destdir, Path(name))
+	if script == nil {
+		err := os.Remove(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	err := os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, script, 0644)
+}
+
+// Mounts /proc and /dev into destdir unless they already are, returning what needs unmounting
+func mountChroot(destdir string) ([]string, error) {
+	mounted := make([]string, 0)
+	mounts := []struct {
+		dir   string
+		check string
+		args  []string
+	}{
+		{"proc", "self", []string{"-t", "proc", "proc"}},
+		{"dev", "null", []string{"--bind", "/dev"}},
+	}
+	for _, m := range mounts {
+		target := filepath.Join(destdir, m.dir)
+		if _, err := os.Stat(filepath.Join(target, m.check)); err == nil {
+			continue
+		}
+		err := os.MkdirAll(target, 0755)
+		if err == nil {
+			err = exec.Command("mount", append(m.args, target)...).Run()
+		}
+		if err != nil {
+			unmountChroot(mounted)
+			return nil, fmt.Errorf("Unable to mount %s: %s", target, err)
+		}
+		mounted = append(mounted, target)
+	}
+	return mounted, nil
+}
+
+func unmountChroot(mounted []string) {
+	for i := len(mounted) - 1; i >= 0; i-- {
+		err := exec.Command("umount", "--lazy", mounted[i]).Run()
+		if err != nil {
+			log.Warn.Format("Unable to unmount %s: %s", mounted[i], err)
+		}
+	}
+}
+
+// The stored hooks of the installed package name, nil if it has none
+func Stored(destdir string, name string) ([]byte, error) {
+	script, err := ioutil.ReadFile(filepath.Join(destdir, Path(name)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return script, err
+}
+
+// Returned by Run when destdir has no shell to run hooks in, hooks never run on the host instead
+var ErrNoShell = errors.New("no /bin/bash to run hooks in")
+
+// Runs the phase hook in script for package name chrooted into destdir, logging its output
+func Run(destdir string, name string, phase string, script []byte) error {
+	if !strings.Contains(string(script), phase+" ()") {
+		return nil
+	}
+	command := string(script) + "\n" + phase
+	cmd := exec.Command("bash", "-c", command)
+	if filepath.Clean(destdir) != "/" {
+		if _, err := os.Stat(filepath.Join(destdir, "bin/bash")); err != nil {
+			return ErrNoShell
+		}
+		mounted, err := mountChroot(destdir)
+		if err != nil {
+			return err
+		}
+		defer unmountChroot(mounted)
+		cmd = exec.Command("chroot", destdir, "/bin/bash", "-c", command)
+	}
+	cmd.Env = append(os.Environ(), "ROOT=/")
+
+	logPath := filepath.Join(destdir, Log)
+	err := os.MkdirAll(filepath.Dir(logPath), 0755)
+	if err != nil {
+		return err
+	}
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	fmt.Fprintf(logFile, "==> %s %s %s\n", time.Now().Format(time.RFC3339), name, phase)
+
+	log.Info.Format("Running %s %s", name, phase)
+	cmd.Stdout = io.MultiWriter(os.Stdout, logFile)
+	cmd.Stderr = io.MultiWriter(os.Stderr, logFile)
+	err = cmd.Run()
+	if err != nil {
+		fmt.Fprintf(logFile, "==> %s %s failed: %s\n", name, phase, err)
+		return fmt.Errorf("%s %s failed: %s", name, phase, err)
+	}
+	return nil
+}
+
+type pending struct {
+	name   string
+	phase  string
+	script []byte
+}
+
+// Runs the install hooks of a transaction, holding back those destdir has no bash for yet until Finish
+type Runner struct {
+	destdir string
+	pending []pending
+}
+
+func NewRunner(destdir string) *Runner {
+	return &Runner{destdir: destdir}
+}
+
+func (r *Runner) Run(name string, phase string, script []byte) error {
+	err := Run(r.destdir, name, phase, script)
+	if err == ErrNoShell {
+		log.Warn.Format("%s has no /bin/bash yet, %s %s will run once everything is installed", r.destdir, name, phase)
+		r.pending = append(r.pending, pending{name, phase, script})
+		return nil
+	}
+	return err
+}
+
+// Runs the held back hooks in order, they all fail if there is still no shell
+func (r *Runner) Finish() []error {
+	failures := make([]error, 0)
+	for _, p := range r.pending {
+		err := Run(r.destdir, p.name, p.phase, p.script)
+		if err == ErrNoShell {
+			err = fmt.Errorf("%s %s could not run, %s still has no /bin/bash", p.name, p.phase, r.destdir)
+		}
+		if err != nil {
+			log.Error.Println(err)
+			failures = append(failures, err)
+		}
+	}
+	r.pending = nil
+	return failures
+}
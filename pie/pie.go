@@ -0,0 +1,12 @@
+// Rules for the contents of .pie templates, shared by forge and spack lint so that they agree
+package pie
+
+import "strings"
+
+// Checksum placeholder for sources that cannot be verified, only allowed for VCS sources
+const SkipChecksum = "SKIP"
+
+// Sources checked out from version control have no fixed content to checksum
+func IsVCSSource(url string) bool {
+	return strings.HasPrefix(url, "git://") || strings.HasPrefix(url, "git+") || strings.HasSuffix(url, ".git")
+}
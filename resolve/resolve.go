@@ -0,0 +1,75 @@
+// How spdl deps select versions and flags, shared by spack and forge so that they agree
+package resolve
+
+import (
+	"strings"
+
+	"github.com/serenitylinux/libspack/control"
+	"github.com/serenitylinux/libspack/flag"
+	"github.com/serenitylinux/libspack/spdl"
+)
+
+// Whether version satisfies the version constraints of dep
+func Accepts(dep spdl.Dep, version string) bool {
+	return (dep.Version1 == nil || dep.Version1.Accepts(version)) && (dep.Version2 == nil || dep.Version2.Accepts(version))
+}
+
+// The flags c is built and installed with, its defaults overridden by those dep asks for
+func Flags(c *control.Control, dep spdl.Dep) flag.FlagList {
+	flags := make(flag.FlagList, 0)
+	requested := make(map[string]bool)
+	if dep.Flags != nil {
+		for _, f := range *dep.Flags {
+			flags = append(flags, f)
+			requested[f.Name()] = true
+		}
+	}
+	for _, f := range c.Flags.Defaults() {
+		if !requested[f.Name()] {
+			flags = append(flags, f)
+		}
+	}
+	return flags
+}
+
+// Whether a dependency only needed with or without some flag applies to a package built with flags
+func Applies(dep spdl.Dep, flags flag.FlagList) bool {
+	if dep.Condition == nil {
+		return true
+	}
+	for _, f := range flags {
+		if f.Name() == dep.Condition.Name() {
+			return f.IsEnabled() == dep.Condition.IsEnabled()
+		}
+	}
+	return !dep.Condition.IsEnabled()
+}
+
+// The deps that apply to a package built with flags
+func Applicable(deps []spdl.Dep, flags flag.FlagList) []spdl.Dep {
+	applicable := make([]spdl.Dep, 0, len(deps))
+	for _, dep := range deps {
+		if Applies(dep, flags) {
+			applicable = append(applicable, dep)
+		}
+	}
+	return applicable
+}
+
+// flags in spdl form, as forge --flags takes them
+func FormatFlags(flags flag.FlagList) string {
+	strs := make([]string, 0, len(flags))
+	for _, f := range flags {
+		strs = append(strs, f.String())
+	}
+	return "[" + strings.Join(strs, " ") + "]"
+}
+
+// Reads flags formatted by FormatFlags for the package name
+func ParseFlags(name string, flags string) (flag.FlagList, error) {
+	dep, err := spdl.ParseDep(name + flags)
+	if err != nil || dep.Flags == nil {
+		return nil, err
+	}
+	return *dep.Flags, nil
+}
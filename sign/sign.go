@@ -0,0 +1,214 @@
+// Signing and verification of spakgs, shared by forge, wield and spack so that they agree on the format.
+// Every spakg carries a manifest of its other entries, and a signature of it when forged with --sign-key.
+package sign
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Public keys of trusted packagers, one base64 encoded <name>.pub per key
+const KeysDir = "/etc/spack/keys"
+
+const ManifestEntry = "manifest"
+const SignatureEntry = "signature"
+const SumsEntry = "md5sums"
+
+// A spakg that is intact but not signed by a trusted key, allowed with --allow-unsigned
+type UntrustedError string
+
+func (e UntrustedError) Error() string {
+	return string(e)
+}
+
+func LoadKeyring(dir string) (map[string]ed25519.PublicKey, error) {
+	keys := make(map[string]ed25519.PublicKey)
+	files, err := filepath.Glob(filepath.Join(dir, "*.pub"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s is not a public key", file)
+		}
+		keys[strings.TrimSuffix(filepath.Base(file), ".pub")] = ed25519.PublicKey(key)
+	}
+	return keys, nil
+}
+
+// Keys are stored base64 encoded, the private key as its 32 byte seed
+func LoadKey(file string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s is not a signing key", file)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// Writes a new key pair as <name>.key and <name>.pub
+func WriteKeyPair(name string) error {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(name + ".key"); err == nil {
+		return fmt.Errorf("%s.key already exists", name)
+	}
+	err = ioutil.WriteFile(name+".key", []byte(base64.StdEncoding.EncodeToString(priv.Seed())+"\n"), 0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name+".pub", []byte(base64.StdEncoding.EncodeToString(pub)+"\n"), 0644)
+}
+
+// The manifest of entries, ignoring any existing manifest and signature
+func Manifest(entries map[string][]byte) []byte {
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		if name != ManifestEntry && name != SignatureEntry {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var manifest strings.Builder
+	for _, name := range names {
+		sum := sha256.Sum256(entries[name])
+		fmt.Fprintf(&manifest, "%s  %s\n", hex.EncodeToString(sum[:]), name)
+	}
+	return []byte(manifest.String())
+}
+
+// The content of the signature entry for manifest
+func Signature(key ed25519.PrivateKey, manifest []byte) []byte {
+	return []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(key, manifest)) + "\n")
+}
+
+// The entries of the spakg at file by name, refusing duplicate and non-regular entries
+func ReadEntries(file string) (map[string][]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	gr, err := gzip.NewReader(f)
+	if err == nil {
+		defer gr.Close()
+		r = gr
+	} else {
+		f.Seek(0, 0)
+	}
+
+	entries := make(map[string][]byte)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("%s is not a regular file", hdr.Name)
+		}
+		if _, exists := entries[hdr.Name]; exists {
+			return nil, fmt.Errorf("%s appears more than once", hdr.Name)
+		}
+		entries[hdr.Name], err = ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// The path keyed md5sums entry, nil if the spakg has none
+func Sums(entries map[string][]byte) (map[string]string, error) {
+	data, exists := entries[SumsEntry]
+	if !exists {
+		return nil, nil
+	}
+	var sums map[string]string
+	err := json.Unmarshal(data, &sums)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s: %s", SumsEntry, err)
+	}
+	return sums, nil
+}
+
+// Checks the spakg at file, returning the signing key's name or an UntrustedError if it is intact but untrusted
+func Verify(file string, keys map[string]ed25519.PublicKey) (string, error) {
+	entries, err := ReadEntries(file)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read %s: %s", file, err)
+	}
+	return VerifyEntries(file, entries, keys)
+}
+
+// Verify for the entries already read from file, which are what anything installing it should use
+func VerifyEntries(file string, entries map[string][]byte, keys map[string]ed25519.PublicKey) (string, error) {
+	manifest, exists := entries[ManifestEntry]
+	if !exists {
+		return "", UntrustedError(file + " has no manifest")
+	}
+
+	listed := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(string(manifest)), "\n") {
+		fields := strings.SplitN(line, "  ", 2)
+		if len(fields) != 2 {
+			return "", fmt.Errorf("%s has an invalid manifest", file)
+		}
+		data, exists := entries[fields[1]]
+		if !exists {
+			return "", fmt.Errorf("%s is missing %s", file, fields[1])
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != fields[0] {
+			return "", fmt.Errorf("%s has been tampered with, %s does not match its checksum", file, fields[1])
+		}
+		listed[fields[1]] = true
+	}
+	for name := range entries {
+		if !listed[name] && name != ManifestEntry && name != SignatureEntry {
+			return "", fmt.Errorf("%s has been tampered with, %s is not in its manifest", file, name)
+		}
+	}
+
+	signature, exists := entries[SignatureEntry]
+	if !exists {
+		return "", UntrustedError(file + " is not signed")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return "", fmt.Errorf("%s has an invalid signature", file)
+	}
+	for name, key := range keys {
+		if ed25519.Verify(key, manifest, sig) {
+			return name, nil
+		}
+	}
+	return "", UntrustedError(file + " is not signed by any key in " + KeysDir)
+}
@@ -0,0 +1,299 @@
+package sign
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testEntries = map[string][]byte{
+	"control": []byte(`{"Name": "tool"}`),
+	"pkginfo": []byte(`{"Name": "tool"}`),
+	"fs.tar":  []byte("filesystem"),
+}
+
+func testKey(t *testing.T) ed25519.PrivateKey {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+type rawEntry struct {
+	hdr  tar.Header
+	data []byte
+}
+
+// Writes entries as a spakg in dir, sorted like forge writes them
+func writeSpakg(t *testing.T, dir string, entries map[string][]byte, compress bool) string {
+	raw := make([]rawEntry, 0, len(entries))
+	for _, name := range []string{"control", "extra", "fs.tar", "hooks", ManifestEntry, "pkginfo", SignatureEntry} {
+		if data, exists := entries[name]; exists {
+			raw = append(raw, rawEntry{tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}, data})
+		}
+	}
+	return writeRaw(t, dir, raw, compress)
+}
+
+// Writes raw as a spakg in dir, in the given order and with the given headers
+func writeRaw(t *testing.T, dir string, raw []rawEntry, compress bool) string {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range raw {
+		hdr := e.hdr
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(e.data))
+		}
+		err := tw.WriteHeader(&hdr)
+		if err == nil && hdr.Typeflag == tar.TypeReg {
+			_, err = tw.Write(e.data)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := buf.Bytes()
+	if compress {
+		var gz bytes.Buffer
+		gw := gzip.NewWriter(&gz)
+		gw.Write(data)
+		gw.Close()
+		data = gz.Bytes()
+	}
+
+	file, err := ioutil.TempFile(dir, "*.spakg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	_, err = file.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+// The test entries with a manifest, and a signature by key unless it is nil
+func signed(key ed25519.PrivateKey) map[string][]byte {
+	entries := make(map[string][]byte)
+	for name, data := range testEntries {
+		entries[name] = data
+	}
+	entries[ManifestEntry] = Manifest(entries)
+	if key != nil {
+		entries[SignatureEntry] = Signature(key, entries[ManifestEntry])
+	}
+	return entries
+}
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sign-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	trusted := testKey(t)
+	other := testKey(t)
+	keys := map[string]ed25519.PublicKey{"trusted": trusted.Public().(ed25519.PublicKey)}
+
+	tests := []struct {
+		name      string
+		entries   func() map[string][]byte
+		compress  bool
+		signer    string
+		untrusted bool
+		fails     bool
+	}{
+		{
+			name:    "signed by a trusted key",
+			entries: func() map[string][]byte { return signed(trusted) },
+			signer:  "trusted",
+		},
+		{
+			name:     "compressed and signed by a trusted key",
+			entries:  func() map[string][]byte { return signed(trusted) },
+			compress: true,
+			signer:   "trusted",
+		},
+		{
+			name: "tampered entry",
+			entries: func() map[string][]byte {
+				entries := signed(trusted)
+				entries["fs.tar"] = []byte("backdoored")
+				return entries
+			},
+			fails: true,
+		},
+		{
+			name: "unlisted entry",
+			entries: func() map[string][]byte {
+				entries := signed(trusted)
+				entries["extra"] = []byte("payload")
+				return entries
+			},
+			fails: true,
+		},
+		{
+			name: "listed entry missing",
+			entries: func() map[string][]byte {
+				entries := signed(trusted)
+				delete(entries, "pkginfo")
+				return entries
+			},
+			fails: true,
+		},
+		{
+			name: "bad signature",
+			entries: func() map[string][]byte {
+				entries := signed(trusted)
+				entries[SignatureEntry] = []byte("not a signature\n")
+				return entries
+			},
+			fails: true,
+		},
+		{
+			name: "signature of another manifest",
+			entries: func() map[string][]byte {
+				entries := signed(trusted)
+				entries[SignatureEntry] = Signature(trusted, []byte("something else"))
+				return entries
+			},
+			untrusted: true,
+		},
+		{
+			name:      "untrusted key",
+			entries:   func() map[string][]byte { return signed(other) },
+			untrusted: true,
+		},
+		{
+			name:      "unsigned",
+			entries:   func() map[string][]byte { return signed(nil) },
+			untrusted: true,
+		},
+		{
+			name:      "no manifest",
+			entries:   func() map[string][]byte { return testEntries },
+			untrusted: true,
+		},
+	}
+
+	for _, test := range tests {
+		file := writeSpakg(t, dir, test.entries(), test.compress)
+		signer, err := Verify(file, keys)
+		_, untrusted := err.(UntrustedError)
+		switch {
+		case test.fails && (err == nil || untrusted):
+			t.Errorf("%s: expected verification to fail, got %v", test.name, err)
+		case test.untrusted && !untrusted:
+			t.Errorf("%s: expected an UntrustedError, got %v", test.name, err)
+		case !test.fails && !test.untrusted && err != nil:
+			t.Errorf("%s: %s", test.name, err)
+		case signer != test.signer:
+			t.Errorf("%s: expected signer %q, got %q", test.name, test.signer, signer)
+		}
+	}
+}
+
+func TestVerifyInjected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sign-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	trusted := testKey(t)
+	keys := map[string]ed25519.PublicKey{"trusted": trusted.Public().(ed25519.PublicKey)}
+	entries := signed(trusted)
+	entries["hooks"] = []byte("post_install () { true; }")
+	entries[ManifestEntry] = Manifest(entries)
+	entries[SignatureEntry] = Signature(trusted, entries[ManifestEntry])
+
+	valid := make([]rawEntry, 0)
+	for _, name := range []string{"control", "fs.tar", "hooks", ManifestEntry, "pkginfo", SignatureEntry} {
+		valid = append(valid, rawEntry{tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}, entries[name]})
+	}
+	injected := rawEntry{tar.Header{Name: "hooks", Typeflag: tar.TypeReg, Mode: 0644}, []byte("post_install () { rm -rf /; }")}
+
+	tests := []struct {
+		name string
+		raw  []rawEntry
+	}{
+		{
+			name: "duplicate entry in front",
+			raw:  append([]rawEntry{injected}, valid...),
+		},
+		{
+			name: "duplicate entry behind",
+			raw:  append(append([]rawEntry{}, valid...), injected),
+		},
+		{
+			name: "symlink entry",
+			raw:  append([]rawEntry{{tar.Header{Name: "extra", Typeflag: tar.TypeSymlink, Linkname: "/etc/shadow"}, nil}}, valid...),
+		},
+		{
+			name: "directory entry",
+			raw:  append([]rawEntry{{tar.Header{Name: "extra/", Typeflag: tar.TypeDir, Mode: 0755}, nil}}, valid...),
+		},
+	}
+
+	_, err = Verify(writeRaw(t, dir, valid, false), keys)
+	if err != nil {
+		t.Fatalf("untampered: %s", err)
+	}
+	for _, test := range tests {
+		for _, compress := range []bool{false, true} {
+			_, err := Verify(writeRaw(t, dir, test.raw, compress), keys)
+			if _, untrusted := err.(UntrustedError); err == nil || untrusted {
+				t.Errorf("%s: expected verification to fail, got %v", test.name, err)
+			}
+		}
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sign-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	err = os.Chdir(dir)
+	if err == nil {
+		err = WriteKeyPair("packager")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if WriteKeyPair("packager") == nil {
+		t.Error("Expected an existing key not to be overwritten")
+	}
+
+	key, err := LoadKey(filepath.Join(dir, "packager.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadKeyring(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Public().(ed25519.PublicKey).Equal(keys["packager"]) {
+		t.Errorf("packager.pub does not match packager.key")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"time"
 
 	"github.com/cam72cam/go-lumberjack/log"
@@ -36,6 +37,7 @@ var outstream = os.Stdout
 var errstream = os.Stderr
 var outarg = ""
 var interactive = false
+var signKey = ""
 
 func arguments() []string {
 	loglevel := "info"
@@ -44,10 +46,14 @@ func arguments() []string {
 	logfileArg := argparse.RegisterString("logfile", "(stdout)", "File to log to, default to standard out")
 	loglevelArg := argparse.RegisterString("loglevel", loglevel, "Log Level")
 	interactiveArg := argparse.RegisterBool("interactive", interactive, "Drop to a shell on error")
+	signKeyArg := argparse.RegisterString("sign-key", "(not set)", "Sign the forged spakgs with this key, see spack keygen")
 
 	items := argparse.EvalDefaultArgs()
 
 	interactive = interactiveArg.Get()
+	if signKeyArg.IsSet() {
+		signKey, _ = filepath.Abs(signKeyArg.Get())
+	}
 
 	if logfileArg.IsSet() {
 		var err error
@@ -160,12 +166,21 @@ func processRepo(r *repo.Repo) {
 		}
 
 		if hasAllDeps {
+			before, _ := filepath.Glob(pkgdir + "*.spakg")
+			existed := make(map[string]bool)
+			for _, file := range before {
+				existed[file] = true
+			}
+
 			pkgarg := fmt.Sprintf("%s::%s::%d", ctrl.Name, ctrl.Version, ctrl.Iteration)
 			cmd := exec.Command("spack", "forge", pkgarg, "--outdir="+pkgdir, "--yes", fmt.Sprintf("--interactive=%t", interactive))
 			fmt.Println(cmd)
 			if outarg != "" {
 				cmd.Args = append(cmd.Args, outarg)
 			}
+			if signKey != "" {
+				cmd.Args = append(cmd.Args, "--sign-key="+signKey)
+			}
 			cmd.Stdout = outstream
 			cmd.Stderr = errstream
 			cmd.Stdin = os.Stdin
@@ -175,9 +190,16 @@ func processRepo(r *repo.Repo) {
 				return
 			}
 
-			err := extractSpakg(outfile, infodir)
-			if err != nil {
-				log.Warn.Format("Unable to load forged %s: %s", p.String(), err)
+			//Index sub-packages (-dev, -dbg etc) split from it along with the package itself
+			after, _ := filepath.Glob(pkgdir + "*.spakg")
+			for _, file := range after {
+				if existed[file] {
+					continue
+				}
+				err := extractSpakg(file, infodir)
+				if err != nil {
+					log.Warn.Format("Unable to load forged %s: %s", file, err)
+				}
 			}
 		}
 	})
@@ -0,0 +1,60 @@
+// The shared libraries of a package as forge records them in its pkginfo, shared by forge and spack.
+package soname
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// The pkginfo field forge records them in
+const Field = "Sonames"
+
+// Shared library names a package needs from elsewhere and the ones it provides
+type Set struct {
+	Needed   []string
+	Provided []string
+}
+
+// Sorted, leaving out the needed libraries the package provides itself
+func NewSet(needed map[string]bool, provided map[string]bool) Set {
+	s := Set{Needed: make([]string, 0), Provided: make([]string, 0)}
+	for lib := range needed {
+		if !provided[lib] {
+			s.Needed = append(s.Needed, lib)
+		}
+	}
+	for lib := range provided {
+		s.Provided = append(s.Provided, lib)
+	}
+	sort.Strings(s.Needed)
+	sort.Strings(s.Provided)
+	return s
+}
+
+// The set in the pkginfo of a spakg's entries, nil for spakgs forged before they were recorded
+func FromEntries(entries map[string][]byte) (*Set, error) {
+	for name, data := range entries {
+		if path.Base(name) != "pkginfo" && !strings.HasSuffix(name, ".pkginfo") {
+			continue
+		}
+		var info map[string]json.RawMessage
+		err := json.Unmarshal(data, &info)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pkginfo: %s", err)
+		}
+		raw, exists := info[Field]
+		if !exists || string(raw) == "null" {
+			return nil, nil
+		}
+		var s Set
+		err = json.Unmarshal(raw, &s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pkginfo: %s", err)
+		}
+		return &s, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cam72cam/go-lumberjack/log"
+	"github.com/serenitylinux/libspack/argparse"
+	"github.com/serenitylinux/libspack/repo"
+	"github.com/serenitylinux/spack/config"
+)
+
+// An installed config file that no longer matches the hash recorded when it was installed
+type savedConfig struct {
+	path string
+	data []byte
+	mode os.FileMode
+	hash string
+}
+
+// Keeps a copy of every config file under root that was edited since its package installed it
+func modifiedConfigs(root string) []savedConfig {
+	saved := make([]savedConfig, 0)
+	for _, r := range repo.GetAllRepos() {
+		r.MapInstalled(root, func(p repo.PkgInstallSet) {
+			for f, hash := range p.Hashes {
+				f = path.Clean("/" + f)
+				if !config.IsConfig(f) {
+					continue
+				}
+				full := filepath.Join(root, f)
+				info, err := os.Lstat(full)
+				if err != nil || !info.Mode().IsRegular() {
+					continue
+				}
+				data, err := ioutil.ReadFile(full)
+				if err != nil || config.Hash(data) == hash {
+					continue
+				}
+				saved = append(saved, savedConfig{full, data, info.Mode(), hash})
+			}
+		})
+	}
+	return saved
+}
+
+// Puts back edited config files replaced during an install
+func protectConfigs(saved []savedConfig) {
+	for _, c := range saved {
+		config.Restore(c.path, c.data, c.mode, c.hash)
+	}
+}
+
+// Every pending .spacknew file under the config dirs of root
+func pendingConfigs(root string) []string {
+	pending := make([]string, 0)
+	for _, dir := range config.Dirs {
+		filepath.Walk(filepath.Join(root, dir), func(file string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() && strings.HasSuffix(file, config.NewSuffix) {
+				pending = append(pending, file)
+			}
+			return nil
+		})
+	}
+	sort.Strings(pending)
+	return pending
+}
+
+func runInteractive(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// Asks what to do with one .spacknew file, returns false to stop merging
+func mergeConfig(stdin *bufio.Reader, newFile string) bool {
+	file := strings.TrimSuffix(newFile, config.NewSuffix)
+	for {
+		fmt.Printf("%s: [d]iff, [k]eep yours, [u]se new, [e]dit yours, [s]kip, [q]uit? ", file)
+		line, err := stdin.ReadString('\n')
+		if err != nil {
+			return false
+		}
+
+		switch strings.TrimSpace(line) {
+		case "d":
+			runInteractive("diff", "-u", file, newFile)
+			continue
+		case "e":
+			editor := os.Getenv("EDITOR")
+			if editor == "" {
+				editor = "vi"
+			}
+			runInteractive(editor, file)
+			continue
+		case "k":
+			err = os.Remove(newFile)
+		case "u":
+			err = os.Rename(newFile, file)
+		case "s":
+			return true
+		case "q":
+			return false
+		default:
+			continue
+		}
+
+		if err != nil {
+			log.Error.Format("%s: %s", file, err)
+			continue
+		}
+		return true
+	}
+}
+
+func configMerge() {
+	argparse.SetBasename(fmt.Sprintf("%s %s [options]", os.Args[0], "config-merge"))
+	registerBaseDir()
+	listArg := argparse.RegisterBool("list", false, "Only list pending "+config.NewSuffix+" files")
+	argparse.EvalDefaultArgs()
+
+	pending := pendingConfigs(Root())
+	if len(pending) == 0 {
+		fmt.Println("No config files to merge")
+		return
+	}
+
+	if listArg.Get() {
+		for _, file := range pending {
+			fmt.Println(file)
+		}
+		return
+	}
+
+	stdin := bufio.NewReader(os.Stdin)
+	for _, file := range pending {
+		if !mergeConfig(stdin, file) {
+			break
+		}
+	}
+}
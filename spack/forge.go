@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/cam72cam/go-lumberjack/color"
+	"github.com/cam72cam/go-lumberjack/log"
+	"github.com/serenitylinux/libspack/control"
+	"github.com/serenitylinux/libspack/misc"
+	"github.com/serenitylinux/libspack/pkginfo"
+	"github.com/serenitylinux/libspack/repo"
+	"github.com/serenitylinux/libspack/spdl"
+	"github.com/serenitylinux/spack/holds"
+	"github.com/serenitylinux/spack/resolve"
+)
+
+// Packages successfully forged by an interrupted or failed run, for --resume
+const forgeStateFile = "/var/lib/spack/forge.state"
+
+type forgeState struct {
+	Built []string
+}
+
+func loadForgeState() forgeState {
+	state := forgeState{Built: make([]string, 0)}
+	data, err := ioutil.ReadFile(forgeStateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn.Format("Unable to read %s: %s", forgeStateFile, err)
+		}
+		return state
+	}
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		log.Warn.Format("Ignoring invalid %s: %s", forgeStateFile, err)
+	}
+	return state
+}
+
+func (state *forgeState) save() {
+	data, err := json.MarshalIndent(state, "", "\t")
+	if err == nil {
+		err = ioutil.WriteFile(forgeStateFile, data, 0644)
+	}
+	if err != nil {
+		log.Warn.Format("Unable to save progress to %s: %s", forgeStateFile, err)
+	}
+}
+
+func (state *forgeState) isBuilt(pkg string) bool {
+	for _, built := range state.Built {
+		if built == pkg {
+			return true
+		}
+	}
+	return false
+}
+
+type forgeResult struct {
+	pkg    string
+	dep    spdl.Dep
+	status string
+	err    error
+}
+
+const (
+	forgeBuilt   = "built"
+	forgeFailed  = "failed"
+	forgeSkipped = "skipped"
+	forgeResumed = "already built"
+)
+
+// Names of everything pkg needs to build or run, following the repos transitively
+func forgeRequires(name string, cache map[string]map[string]bool) map[string]bool {
+	if reqs, exists := cache[name]; exists {
+		return reqs
+	}
+	reqs := make(map[string]bool)
+	cache[name] = reqs
+
+	c, _ := repo.GetPackageLatest(name)
+	if c == nil {
+		return reqs
+	}
+	for _, dep := range append(append([]spdl.Dep{}, c.Bdeps...), c.Deps...) {
+		reqs[dep.Name] = true
+		for sub := range forgeRequires(dep.Name, cache) {
+			reqs[sub] = true
+		}
+	}
+	return reqs
+}
+
+// Orders results so that requested packages are forged after any other requested package they need
+func forgeOrder(results []*forgeResult, requires map[string]map[string]bool) []*forgeResult {
+	ordered := make([]*forgeResult, 0, len(results))
+	visited := make(map[*forgeResult]bool)
+
+	var visit func(r *forgeResult)
+	visit = func(r *forgeResult) {
+		if visited[r] {
+			return
+		}
+		visited[r] = true
+		for _, other := range results {
+			if other != r && requires[r.dep.Name][other.dep.Name] {
+				visit(other)
+			}
+		}
+		ordered = append(ordered, r)
+	}
+
+	for _, r := range results {
+		visit(r)
+	}
+	return ordered
+}
+
+func printForgeSummary(results []*forgeResult) {
+	longest := 0
+	for _, r := range results {
+		if len(r.pkg) > longest {
+			longest = len(r.pkg)
+		}
+	}
+
+	fmt.Println()
+	fmt.Println("Forge summary:")
+	for _, r := range results {
+		gap := strings.Repeat(" ", longest-len(r.pkg)+2)
+		status := color.Green.String(r.status)
+		switch r.status {
+		case forgeFailed:
+			status = color.Red.String(r.status)
+		case forgeSkipped:
+			status = color.White.String(r.status)
+		}
+
+		line := "  " + r.pkg + gap + status
+		if r.err != nil {
+			line += " (" + r.err.Error() + ")"
+		}
+		fmt.Println(line)
+	}
+}
+
+// Forges each package separately, recording progress for --resume
+func forgeEach(pkgs []string, deps []spdl.Dep, outdir string, keepGoing bool, resume bool) bool {
+	state := forgeState{Built: make([]string, 0)}
+	if resume {
+		state = loadForgeState()
+	}
+
+	results := make([]*forgeResult, len(pkgs))
+	requires := make(map[string]map[string]bool)
+	for i := range pkgs {
+		results[i] = &forgeResult{pkg: pkgs[i], dep: deps[i]}
+		forgeRequires(deps[i].Name, requires)
+	}
+	results = forgeOrder(results, requires)
+
+	failed := make([]string, 0)
+	stopped := false
+	for _, r := range results {
+		if state.isBuilt(r.pkg) {
+			r.status = forgeResumed
+			continue
+		}
+
+		if stopped {
+			r.status = forgeSkipped
+			r.err = fmt.Errorf("not attempted")
+			continue
+		}
+
+		for _, f := range failed {
+			if requires[r.dep.Name][f] {
+				r.status = forgeSkipped
+				r.err = fmt.Errorf("requires %s", f)
+				break
+			}
+		}
+		if r.status != "" {
+			continue
+		}
+
+		r.err = forgePackage(r.dep, outdir)
+		if r.err != nil {
+			r.status = forgeFailed
+			failed = append(failed, r.dep.Name)
+			stopped = !keepGoing
+			state.save()
+			continue
+		}
+
+		r.status = forgeBuilt
+		state.Built = append(state.Built, r.pkg)
+		state.save()
+	}
+
+	printForgeSummary(results)
+
+	if len(failed) == 0 && misc.PathExists(forgeStateFile) {
+		os.Remove(forgeStateFile)
+	}
+	return len(failed) == 0
+}
+
+func forgePackage(dep spdl.Dep, outdir string) error {
+	c, r, err := resolvePinned(dep, holds.Load(Root()))
+	if err != nil {
+		return err
+	}
+	return forgeBuild(c, r, dep, outdir)
+}
+
+// Builds c with the flags dep asks for into the repo's spakg cache, and outdir if set
+func forgeBuild(c *control.Control, r *repo.Repo, dep spdl.Dep, outdir string) error {
+	template := ""
+	r.MapByName(c.Name, func(e repo.Entry) {
+		if e.Control.String() == c.String() {
+			template = e.Template
+		}
+	})
+	if template == "" || !misc.PathExists(template) {
+		return fmt.Errorf("No template available for %s", c.String())
+	}
+
+	allowUnsigned := allowUnsignedArg != nil && allowUnsignedArg.Get()
+	flags := resolve.Flags(c, dep)
+
+	//Isolated builds get their Bdeps installed into the build root by the forge tool
+	if buildLocalArg.Get() && !noBDepsArg.Get() && len(c.Bdeps) > 0 {
+		bdeps := resolve.Applicable(c.Bdeps, flags)
+		err := wieldChecked(bdeps, Root(), wieldOptions{withDeps: true, allowUnsigned: allowUnsigned})
+		if err != nil {
+			return fmt.Errorf("Unable to install build deps of %s: %s", c.String(), err)
+		}
+	}
+
+	//Only spack forge registers these, wield forges packages only available as templates without them
+	args := []string{
+		"--output=" + r.GetSpakgOutput(pkginfo.FromControl(c)),
+		fmt.Sprintf("--isolate=%t", !buildLocalArg.Get()),
+		fmt.Sprintf("--interactive=%t", interactiveArg != nil && interactiveArg.Get()),
+		fmt.Sprintf("--allow-unsigned=%t", allowUnsigned),
+		"--flags=" + resolve.FormatFlags(flags),
+	}
+	if signKeyArg != nil && signKeyArg.IsSet() {
+		key, err := filepath.Abs(signKeyArg.Get())
+		if err != nil {
+			return err
+		}
+		args = append(args, "--sign-key="+key)
+	}
+	if outdir != "" {
+		args = append(args, "--outdir="+outdir)
+	}
+	if verboseArg.Get() {
+		args = append(args, "--verbose")
+	}
+	if quietArg.Get() {
+		args = append(args, "--quiet")
+	}
+
+	cmd := exec.Command("forge", append(args, template)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("Unable to forge %s: %s", c.String(), err)
+	}
+	return nil
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
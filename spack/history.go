@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cam72cam/go-lumberjack/log"
+	"github.com/serenitylinux/libspack/argparse"
+	"github.com/serenitylinux/libspack/repo"
+)
+
+// One JSON transaction per line, only ever appended to
+const transactionsFile = "var/lib/spack/transactions.json"
+
+// Captured before main strips the command from os.Args
+var commandLine = append([]string{}, os.Args...)
+
+const resultOk = "ok"
+
+type pkgChange struct {
+	Name string
+	//Before is empty for newly installed packages, After for removed ones
+	Before string
+	After  string
+	//Retained spakg of Before
+	Spakg string `json:",omitempty"`
+}
+
+type transaction struct {
+	Id        int
+	Time      time.Time
+	Command   []string
+	Operation string
+	//"ok" or why the operation failed
+	Result  string
+	Changes []pkgChange
+}
+
+func (t transaction) summary() string {
+	added, removed, changed := 0, 0, 0
+	for _, change := range t.Changes {
+		switch {
+		case change.Before == "":
+			added++
+		case change.After == "":
+			removed++
+		default:
+			changed++
+		}
+	}
+	return fmt.Sprintf("+%d -%d ~%d", added, removed, changed)
+}
+
+func loadTransactions(root string) []transaction {
+	transactions := make([]transaction, 0)
+	f, err := os.Open(filepath.Join(root, transactionsFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn.Format("Unable to read transactions: %s", err)
+		}
+		return transactions
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var t transaction
+		if json.Unmarshal(scanner.Bytes(), &t) != nil {
+			log.Warn.Format("Skipping invalid transaction: %s", scanner.Text())
+			continue
+		}
+		transactions = append(transactions, t)
+	}
+	return transactions
+}
+
+func appendTransaction(root string, t transaction) error {
+	file := filepath.Join(root, transactionsFile)
+	err := os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Records operation and what it changed in root since before
+func recordTransaction(root string, operation string, before map[string]repo.PkgInstallSet, retained map[string]string, opErr error) *transaction {
+	after := installedPackages(root)
+	changes := make([]pkgChange, 0)
+	for name, p := range after {
+		old, existed := before[name]
+		switch {
+		case !existed:
+			changes = append(changes, pkgChange{Name: name, After: p.Control.String()})
+		case old.Control.String() != p.Control.String():
+			changes = append(changes, pkgChange{Name: name, Before: old.Control.String(), After: p.Control.String(), Spakg: retained[name]})
+		}
+	}
+	for name, p := range before {
+		if _, exists := after[name]; !exists {
+			changes = append(changes, pkgChange{Name: name, Before: p.Control.String(), Spakg: retained[name]})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+
+	t := transaction{
+		Id:        1,
+		Time:      time.Now(),
+		Command:   commandLine,
+		Operation: operation,
+		Result:    resultOk,
+		Changes:   changes,
+	}
+	if opErr != nil {
+		t.Result = opErr.Error()
+	}
+	transactions := loadTransactions(root)
+	if len(transactions) > 0 {
+		t.Id = transactions[len(transactions)-1].Id + 1
+	}
+	err := appendTransaction(root, t)
+	if err != nil {
+		log.Warn.Format("Unable to record transaction: %s", err)
+	}
+	return &t
+}
+
+func printTransaction(t transaction) {
+	fmt.Printf("Transaction %d, %s\n", t.Id, t.Time.Format(time.RFC1123))
+	fmt.Printf("  Command: %s\n", strings.Join(t.Command, " "))
+	fmt.Printf("  Result:  %s\n", t.Result)
+	if len(t.Changes) == 0 {
+		fmt.Println("  No packages changed")
+		return
+	}
+	for _, change := range t.Changes {
+		switch {
+		case change.Before == "":
+			fmt.Printf("  + %s\n", change.After)
+		case change.After == "":
+			fmt.Printf("  - %s\n", change.Before)
+		default:
+			fmt.Printf("  ~ %s -> %s\n", change.Before, change.After)
+		}
+	}
+	fmt.Printf("Undo with: spack rollback --transaction %d\n", t.Id)
+}
+
+func history() {
+	argparse.SetBasename(fmt.Sprintf("%s %s [options] [transaction id]", os.Args[0], "history"))
+	registerBaseDir()
+	ids := argparse.EvalDefaultArgs()
+
+	transactions := loadTransactions(Root())
+	if len(transactions) == 0 {
+		fmt.Println("No transactions recorded")
+		return
+	}
+
+	if len(ids) > 0 {
+		for _, arg := range ids {
+			id, err := strconv.Atoi(arg)
+			found := false
+			for _, t := range transactions {
+				if err == nil && t.Id == id {
+					printTransaction(t)
+					found = true
+				}
+			}
+			if !found {
+				log.Error.Format("No transaction %s", arg)
+				os.Exit(1)
+			}
+		}
+		return
+	}
+
+	for _, t := range transactions {
+		result := t.Result
+		if result != resultOk {
+			result = "failed"
+		}
+		fmt.Printf("%4d  %s  %-10s %-7s %-12s %s\n", t.Id, t.Time.Format("2006-01-02 15:04"), t.Operation, result, t.summary(), strings.Join(t.Command, " "))
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/cam72cam/go-lumberjack/log"
+	"github.com/serenitylinux/libspack/argparse"
+	"github.com/serenitylinux/libspack/control"
+	"github.com/serenitylinux/libspack/repo"
+	"github.com/serenitylinux/libspack/spdl"
+	"github.com/serenitylinux/spack/holds"
+	"github.com/serenitylinux/spack/resolve"
+)
+
+// Resolves dep to the newest version it accepts, or to its pin if the package is pinned
+func resolvePinned(dep spdl.Dep, h holds.Holds) (*control.Control, *repo.Repo, error) {
+	pinned, isPinned := h.Pinned[dep.Name]
+	switch {
+	case isPinned && !resolve.Accepts(dep, pinned):
+		return nil, nil, fmt.Errorf("%s is pinned to %s but %s was requested, release it with spack pin --release %s", dep.Name, pinned, dep.String(), dep.Name)
+	case isPinned:
+		c, r := repo.GetPackageVersion(dep.Name, pinned)
+		if c == nil {
+			return nil, nil, fmt.Errorf("%s is pinned to %s, which is not available in any repo", dep.Name, pinned)
+		}
+		return c, r, nil
+	case dep.Version1 == nil && dep.Version2 == nil:
+		c, r := repo.GetPackageLatest(dep.Name)
+		if c == nil {
+			return nil, nil, fmt.Errorf("Unable to find package %s", dep.Name)
+		}
+		return c, r, nil
+	}
+
+	var c *control.Control
+	var r *repo.Repo
+	for _, other := range repo.GetAllRepos() {
+		other.MapByName(dep.Name, func(e repo.Entry) {
+			if resolve.Accepts(dep, e.Control.Version) && (c == nil || e.Control.GreaterThan(*c)) {
+				found := e.Control
+				c, r = &found, other
+			}
+		})
+	}
+	if c == nil {
+		return nil, nil, fmt.Errorf("Unable to find a version of %s matching %s", dep.Name, dep.String())
+	}
+	return c, r, nil
+}
+
+// Refuses plans that would reinstall, upgrade or downgrade a held package
+func checkHeld(plan []*planItem, root string) error {
+	h := holds.Load(root)
+	if len(h.Held) == 0 {
+		return nil
+	}
+	installed := installedPackages(root)
+	held := make([]string, 0)
+	for _, item := range plan {
+		if p, exists := installed[item.control.Name]; exists && h.IsHeld(item.control.Name) {
+			log.Error.Format("%s is held at %s, release it with spack hold --release %s", item.control.Name, p.Control.String(), item.control.Name)
+			held = append(held, item.control.Name)
+		}
+	}
+	if len(held) > 0 {
+		return fmt.Errorf("Refusing to change held packages %s", strings.Join(held, ", "))
+	}
+	return nil
+}
+
+func printHolds(h holds.Holds) {
+	if len(h.Held) == 0 && len(h.Pinned) == 0 {
+		fmt.Println("No packages are held or pinned")
+		return
+	}
+	for _, name := range h.Held {
+		fmt.Println(name + " held")
+	}
+	names := make([]string, 0, len(h.Pinned))
+	for name := range h.Pinned {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%s pinned to %s\n", name, h.Pinned[name])
+	}
+}
+
+func hold() {
+	argparse.SetBasename(fmt.Sprintf("%s %s [options] [package(s)]", os.Args[0], "hold"))
+	registerBaseDir()
+	releaseArg := argparse.RegisterBool("release", false, "Release the hold on package(s)")
+	pkgs := argparse.EvalDefaultArgs()
+
+	root := Root()
+	h := holds.Load(root)
+	if len(pkgs) == 0 {
+		printHolds(h)
+		return
+	}
+
+	failed := false
+	for _, pkg := range pkgs {
+		name, _, _ := pkgSplit(pkg)
+		held := make([]string, 0, len(h.Held)+1)
+		for _, other := range h.Held {
+			if other != name {
+				held = append(held, other)
+			}
+		}
+		if releaseArg.Get() {
+			if !h.IsHeld(name) {
+				log.Error.Format("%s is not held", name)
+				failed = true
+				continue
+			}
+			fmt.Println("Released " + name)
+		} else {
+			held = append(held, name)
+			fmt.Println("Holding " + name)
+		}
+		h.Held = held
+	}
+	sort.Strings(h.Held)
+
+	err := h.Save(root)
+	if err != nil {
+		log.Error.Format("Unable to save holds: %s", err)
+		os.Exit(1)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func pin() {
+	argparse.SetBasename(fmt.Sprintf("%s %s [options] [package::version ...]", os.Args[0], "pin"))
+	registerBaseDir()
+	releaseArg := argparse.RegisterBool("release", false, "Remove the pin on package(s)")
+	pkgs := argparse.EvalDefaultArgs()
+
+	root := Root()
+	h := holds.Load(root)
+	if len(pkgs) == 0 {
+		printHolds(h)
+		return
+	}
+
+	for _, pkg := range pkgs {
+		name, version, iteration := pkgSplit(pkg)
+		if releaseArg.Get() {
+			delete(h.Pinned, name)
+			fmt.Println("Unpinned " + name)
+			continue
+		}
+
+		if version == nil {
+			log.Error.Format("Must specify a version to pin %s to, as %s::version", name, name)
+			os.Exit(2)
+		}
+		if iteration != nil {
+			log.Error.Format("Pins are by version, pin %s to %s::%s instead", name, name, *version)
+			os.Exit(2)
+		}
+		if found, _ := repo.GetPackageVersion(name, *version); found == nil {
+			log.Warn.Format("%s::%s is not available in any repo", name, *version)
+		}
+		h.Pinned[name] = *version
+		fmt.Printf("Pinned %s to %s\n", name, *version)
+	}
+
+	err := h.Save(root)
+	if err != nil {
+		log.Error.Format("Unable to save pins: %s", err)
+		os.Exit(1)
+	}
+}
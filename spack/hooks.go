@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/cam72cam/go-lumberjack/log"
+	"github.com/serenitylinux/libspack/pkginfo"
+	"github.com/serenitylinux/libspack/repo"
+	"github.com/serenitylinux/spack/hooks"
+)
+
+// Runs phase from the verified hooks of every package in plan, dependencies included, returning the failures
+func runPlanHooks(plan []*planItem, runner *hooks.Runner, phase string) []error {
+	failures := make([]error, 0)
+	for _, item := range plan {
+		err := runner.Run(item.control.Name, phase, item.entries[hooks.Entry])
+		if err != nil {
+			log.Error.Println(err)
+			failures = append(failures, err)
+		}
+	}
+	return failures
+}
+
+// Keeps the hooks of the installed plan for its remove hooks, dropping those of versions that had some
+func storePlanHooks(plan []*planItem, root string) {
+	for _, item := range plan {
+		err := hooks.Store(root, item.control.Name, item.entries[hooks.Entry])
+		if err != nil {
+			log.Warn.Format("Unable to store the hooks of %s: %s", item.control.String(), err)
+		}
+	}
+}
+
+// Uninstalls p from root between its remove hooks, a failing pre_remove keeps it installed
+func uninstallWithHooks(r *repo.Repo, p *pkginfo.PkgInfo, root string) error {
+	script, err := hooks.Stored(root, p.Name)
+	if err == nil {
+		err = hooks.Run(root, p.Name, hooks.PreRemove, script)
+	}
+	if err != nil {
+		return err
+	}
+	err = r.Uninstall(p, root)
+	if err != nil {
+		return err
+	}
+
+	err = hooks.Run(root, p.Name, hooks.PostRemove, script)
+	if err != nil {
+		log.Error.Println(err)
+	}
+	return hooks.Store(root, p.Name, nil)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/cam72cam/go-lumberjack/log"
+	"github.com/serenitylinux/libspack/argparse"
+	"github.com/serenitylinux/libspack/control"
+	"github.com/serenitylinux/libspack/misc"
+	"github.com/serenitylinux/libspack/repo"
+	"github.com/serenitylinux/spack/pie"
+)
+
+const templateExt = ".pie"
+
+// '-' and '_' separate name, version and iteration in package file names
+var versionRgx = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z.+~]*$`)
+
+// Flags are referenced in deps as +flag or -flag inside [] or ()
+var flagRefRgx = regexp.MustCompile(`[\[(][^\])]*[\])]`)
+var flagNameRgx = regexp.MustCompile(`[+-]([A-Za-z0-9_]+)`)
+
+// Prints each requested bash array of the template, one "name value" per line
+const lintArraysScript = `source "$1" >/dev/null 2>&1
+shift
+for a in "$@"; do eval 'for v in "${'"$a"'[@]}"; do echo "$a $v"; done'; done`
+
+type lintIssue struct {
+	file  string
+	fatal bool
+	msg   string
+}
+
+type linter struct {
+	issues []lintIssue
+	//name::version::iteration to the template declaring it
+	seen map[string]string
+}
+
+func (l *linter) errorf(file string, format string, args ...interface{}) {
+	l.issues = append(l.issues, lintIssue{file, true, fmt.Sprintf(format, args...)})
+}
+
+func (l *linter) warnf(file string, format string, args ...interface{}) {
+	l.issues = append(l.issues, lintIssue{file, false, fmt.Sprintf(format, args...)})
+}
+
+func templateArrays(template string, names ...string) (map[string][]string, error) {
+	args := append([]string{"-c", lintArraysScript, "bash", template}, names...)
+	out, err := misc.RunCommandToString(exec.Command("bash", args...))
+	if err != nil {
+		return nil, err
+	}
+
+	arrays := make(map[string][]string)
+	for _, line := range strings.Split(out, "\n") {
+		split := strings.SplitN(line, " ", 2)
+		if len(split) == 2 {
+			arrays[split[0]] = append(arrays[split[0]], split[1])
+		}
+	}
+	return arrays, nil
+}
+
+func (l *linter) lintTemplate(template string) {
+	c, err := control.FromTemplateFile(template)
+	if err != nil {
+		l.errorf(template, "unable to parse: %s", err)
+		return
+	}
+
+	if c.Name == "" {
+		l.errorf(template, "missing name")
+	}
+	if c.Version == "" {
+		l.errorf(template, "missing version")
+	} else if !versionRgx.MatchString(c.Version) {
+		l.errorf(template, "invalid version %q, must match %s", c.Version, versionRgx)
+	}
+	if c.Description == "" {
+		l.warnf(template, "missing description")
+	}
+
+	key := fmt.Sprintf("%s::%s::%d", c.Name, c.Version, c.Iteration)
+	if other, exists := l.seen[key]; exists {
+		l.errorf(template, "%s is also declared by %s", key, other)
+	} else {
+		l.seen[key] = template
+	}
+
+	arrays, err := templateArrays(template, "src", "sha256sums", "flags", "deps", "bdeps")
+	if err != nil {
+		l.errorf(template, "unable to read arrays: %s", err)
+		return
+	}
+
+	if len(arrays["sha256sums"]) != len(arrays["src"]) {
+		l.errorf(template, "%d sources but %d sha256sums", len(arrays["src"]), len(arrays["sha256sums"]))
+	}
+	for i, sum := range arrays["sha256sums"] {
+		if i < len(arrays["src"]) && strings.EqualFold(sum, pie.SkipChecksum) && !pie.IsVCSSource(arrays["src"][i]) {
+			l.errorf(template, "%s has no checksum", arrays["src"][i])
+		}
+	}
+
+	declared := make(map[string]bool)
+	for _, f := range arrays["flags"] {
+		declared[strings.TrimLeft(f, "+-")] = true
+	}
+	for _, kind := range []string{"deps", "bdeps"} {
+		for _, dep := range arrays[kind] {
+			for _, group := range flagRefRgx.FindAllString(dep, -1) {
+				for _, match := range flagNameRgx.FindAllStringSubmatch(group, -1) {
+					if !declared[match[1]] {
+						l.errorf(template, "%s %q references undeclared flag %s", kind, dep, match[1])
+					}
+				}
+			}
+		}
+	}
+
+	for _, dep := range c.Deps {
+		if found, _ := repo.GetPackageLatest(dep.Name); found == nil {
+			l.errorf(template, "dep %s cannot be found in any configured repo", dep.Name)
+		}
+	}
+	for _, dep := range c.Bdeps {
+		if found, _ := repo.GetPackageLatest(dep.Name); found == nil {
+			l.errorf(template, "bdep %s cannot be found in any configured repo", dep.Name)
+		}
+	}
+}
+
+func (l *linter) lintPath(p string) {
+	stat, err := os.Stat(p)
+	if err != nil {
+		l.errorf(p, "%s", err)
+		return
+	}
+	if !stat.IsDir() {
+		l.lintTemplate(p)
+		return
+	}
+
+	templates := make([]string, 0)
+	filepath.Walk(p, func(file string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && strings.HasSuffix(file, templateExt) {
+			templates = append(templates, file)
+		}
+		return nil
+	})
+	sort.Strings(templates)
+
+	if len(templates) == 0 {
+		l.warnf(p, "no %s templates found", templateExt)
+	}
+	for _, template := range templates {
+		l.lintTemplate(template)
+	}
+}
+
+func lint() {
+	argparse.SetBasename(fmt.Sprintf("%s %s [options] [template(s)|repo dir(s)]", os.Args[0], "lint"))
+	strictArg := argparse.RegisterBool("strict", false, "Treat warnings as errors")
+	paths := argparse.EvalDefaultArgs()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	l := &linter{issues: make([]lintIssue, 0), seen: make(map[string]string)}
+	for _, p := range paths {
+		l.lintPath(p)
+	}
+
+	failed := false
+	for _, issue := range l.issues {
+		level := "warning"
+		if issue.fatal || strictArg.Get() {
+			level = "error"
+			failed = true
+		}
+		fmt.Printf("%s: %s: %s\n", issue.file, level, issue.msg)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+	if len(l.issues) == 0 {
+		log.Info.Format("No problems found in %s", strings.Join(paths, " "))
+	}
+}
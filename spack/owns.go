@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cam72cam/go-lumberjack/log"
+	"github.com/serenitylinux/libspack/argparse"
+	"github.com/serenitylinux/libspack/pkginfo"
+	"github.com/serenitylinux/libspack/repo"
+	"github.com/serenitylinux/spack/sign"
+)
+
+var forceArg *argparse.BoolValue = nil
+
+func registerForceArg() {
+	forceArg = argparse.RegisterBool("force", false, "Overwrite files owned by other installed packages and install despite missing shared libraries")
+}
+
+// Maps every file installed under root to the packages that installed it
+func fileOwners(root string) map[string][]*pkginfo.PkgInfo {
+	owners := make(map[string][]*pkginfo.PkgInfo)
+	for _, r := range repo.GetAllRepos() {
+		r.MapInstalled(root, func(p repo.PkgInstallSet) {
+			for f := range p.Hashes {
+				f = path.Clean("/" + f)
+				owners[f] = append(owners[f], p.PkgInfo)
+			}
+		})
+	}
+	return owners
+}
+
+// Files of plan owned by installed packages it does not replace, or by more than one planned package
+func fileConflicts(plan []*planItem, root string) ([]string, error) {
+	inPlan := make(map[string]bool)
+	for _, item := range plan {
+		inPlan[item.control.Name] = true
+	}
+
+	owners := fileOwners(root)
+	planned := make(map[string]*planItem)
+	conflicts := make([]string, 0)
+	for _, item := range plan {
+		sums, err := sign.Sums(item.entries)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to check %s for conflicts: %s", item.file, err)
+		}
+		for f := range sums {
+			f = path.Clean("/" + f)
+			if other, exists := planned[f]; exists {
+				conflicts = append(conflicts, fmt.Sprintf("%s: %s is also in %s", item.control.String(), f, other.control.String()))
+			}
+			planned[f] = item
+			for _, owner := range owners[f] {
+				//A package replaced in the same wield only conflicts if its new version still has the file
+				if owner.Name != item.control.Name && !inPlan[owner.Name] {
+					conflicts = append(conflicts, fmt.Sprintf("%s: %s is owned by %s", item.control.String(), f, owner.String()))
+				}
+			}
+		}
+	}
+	sort.Strings(conflicts)
+	return conflicts, nil
+}
+
+// Refuses plan if it would overwrite another package's files, unless force
+func checkConflicts(plan []*planItem, root string, force bool) error {
+	conflicts, err := fileConflicts(plan, root)
+	if err != nil || len(conflicts) == 0 {
+		return err
+	}
+	for _, conflict := range conflicts {
+		if force {
+			log.Warn.Println(conflict)
+		} else {
+			log.Error.Println(conflict)
+		}
+	}
+	if !force {
+		return fmt.Errorf("Refusing to overwrite files owned by other packages, use --force to override")
+	}
+	return nil
+}
+
+func owns() {
+	argparse.SetBasename(fmt.Sprintf("%s %s [options] path(s)", os.Args[0], "owns"))
+	registerBaseDir()
+	paths := argparse.EvalDefaultArgs()
+	if len(paths) == 0 {
+		fmt.Println("Must specify path(s)!")
+		argparse.Usage(2)
+	}
+
+	root := Root()
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		log.Error.Println(err)
+		os.Exit(1)
+	}
+	owners := fileOwners(root)
+	found := true
+	for _, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err == nil {
+			//Paths are given as seen from the host, ownership is recorded relative to root
+			p, err = filepath.Rel(absRoot, abs)
+		}
+		if err == nil && (p == ".." || strings.HasPrefix(p, "../")) {
+			err = fmt.Errorf("%s is outside of %s", abs, absRoot)
+		}
+		if err != nil {
+			log.Error.Println(err)
+			os.Exit(1)
+		}
+		rel := path.Clean("/" + p)
+
+		if len(owners[rel]) == 0 {
+			fmt.Printf("%s is not owned by any package\n", rel)
+			found = false
+			continue
+		}
+		for _, owner := range owners[rel] {
+			fmt.Printf("%s is owned by %s\n", rel, owner.String())
+		}
+	}
+	if !found {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/cam72cam/go-lumberjack/log"
+	"github.com/serenitylinux/libspack"
+	"github.com/serenitylinux/libspack/control"
+	"github.com/serenitylinux/libspack/crunch"
+	"github.com/serenitylinux/libspack/misc"
+	"github.com/serenitylinux/libspack/pkginfo"
+	"github.com/serenitylinux/libspack/repo"
+	"github.com/serenitylinux/libspack/spdl"
+	"github.com/serenitylinux/spack/holds"
+	"github.com/serenitylinux/spack/hooks"
+	"github.com/serenitylinux/spack/resolve"
+)
+
+// A package about to be wielded and the spakg it is installed from
+type planItem struct {
+	control *control.Control
+	repo    *repo.Repo
+	//What the package was resolved from, carrying the flags it is installed with
+	dep  spdl.Dep
+	file string
+	//The spakg's entries as verified, everything checked or run before install reads these rather than file
+	entries map[string][]byte
+	//Requested rather than pulled in as a missing dependency
+	explicit bool
+	//Forged from its template by this run instead of fetched
+	forged bool
+}
+
+// The exact version and iteration of the package, as accepted by getPkg and spdl
+func (item *planItem) pkg() string {
+	return fmt.Sprintf("%s::%s::%d", item.control.Name, item.control.Version, item.control.Iteration)
+}
+
+type wieldOptions struct {
+	withDeps      bool
+	reinstall     bool
+	allowUnsigned bool
+	//Overwrite files owned by other packages
+	force bool
+	//Refuse to change held packages, build deps installed by forge leave that to the user's own requests
+	honorHolds bool
+}
+
+func planNames(plan []*planItem) []string {
+	names := make([]string, 0, len(plan))
+	for _, item := range plan {
+		names = append(names, item.control.Name)
+	}
+	return names
+}
+
+// Resolves deps and, withDeps, every dependency not satisfied under root, each ordered after what it needs
+func resolvePlan(deps []spdl.Dep, root string, withDeps bool, reinstall bool) ([]*planItem, error) {
+	installed := installedPackages(root)
+	h := holds.Load(root)
+
+	requested := make(map[string]*planItem)
+	order := make([]string, 0, len(deps))
+	for _, dep := range deps {
+		c, r, err := resolvePinned(dep, h)
+		if err != nil {
+			return nil, err
+		}
+		if p, exists := installed[c.Name]; exists && !reinstall && p.Control.String() == c.String() {
+			log.Info.Format("%s is already installed", c.String())
+			continue
+		}
+		requested[c.Name] = &planItem{control: c, repo: r, dep: dep, explicit: true}
+		order = append(order, c.Name)
+	}
+
+	plan := make([]*planItem, 0)
+	visited := make(map[string]bool)
+	var visit func(item *planItem) error
+	visit = func(item *planItem) error {
+		if visited[item.control.Name] {
+			return nil
+		}
+		visited[item.control.Name] = true
+
+		if withDeps {
+			for _, dep := range resolve.Applicable(item.control.Deps, resolve.Flags(item.control, item.dep)) {
+				if p, exists := installed[dep.Name]; exists && resolve.Accepts(dep, p.Control.Version) {
+					continue
+				}
+				next, explicit := requested[dep.Name]
+				if !explicit {
+					c, r, err := resolvePinned(dep, h)
+					if err != nil {
+						return fmt.Errorf("%s, required by %s", err, item.control.String())
+					}
+					next = &planItem{control: c, repo: r, dep: dep}
+				}
+				err := visit(next)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		plan = append(plan, item)
+		return nil
+	}
+
+	for _, name := range order {
+		err := visit(requested[name])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return plan, nil
+}
+
+// Fetches the spakg of every item into the repo cache, forging those only available as a template
+func fetchPlan(plan []*planItem) error {
+	for _, item := range plan {
+		p := pkginfo.FromControl(item.control)
+		item.file = item.repo.GetSpakgOutput(p)
+		if misc.PathExists(item.file) {
+			continue
+		}
+
+		available, template := false, ""
+		item.repo.MapByName(item.control.Name, func(e repo.Entry) {
+			if e.Control.String() == item.control.String() {
+				available = len(e.Available) > 0
+				template = e.Template
+			}
+		})
+
+		var err error
+		switch {
+		case available:
+			log.Info.Format("Fetching %s", item.control.String())
+			err = item.repo.FetchIfNotCachedSpakg(p)
+		case template != "":
+			err = forgeBuild(item.control, item.repo, item.dep, "")
+			item.forged = true
+		default:
+			err = fmt.Errorf("neither a spakg nor a template is available")
+		}
+		if err == nil && !misc.PathExists(item.file) {
+			err = fmt.Errorf("%s is missing", item.file)
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to get %s: %s", item.control.String(), err)
+		}
+	}
+	return nil
+}
+
+// Resolves and fetches everything wielding deps into root would install, and checks it before anything is installed
+func preparePlan(deps []spdl.Dep, root string, opts wieldOptions) ([]*planItem, error) {
+	plan, err := resolvePlan(deps, root, opts.withDeps, opts.reinstall)
+	if err == nil && opts.honorHolds {
+		err = checkHeld(plan, root)
+	}
+	if err == nil {
+		err = fetchPlan(plan)
+	}
+	if err == nil {
+		err = checkPlan(plan, root, opts)
+	}
+	return plan, err
+}
+
+// Checks the fetched spakgs of plan against their signatures and what is installed under root
+func checkPlan(plan []*planItem, root string, opts wieldOptions) error {
+	err := verifyPlan(plan, opts.allowUnsigned)
+	if err == nil {
+		err = checkConflicts(plan, root, opts.force)
+	}
+	if err == nil {
+		err = checkSonames(plan, root, opts.force)
+	}
+	return err
+}
+
+// Installs exactly the checked spakgs of plan after their pre_install hooks
+func installPlan(plan []*planItem, root string, opts wieldOptions, runner *hooks.Runner) error {
+	if len(plan) == 0 {
+		return nil
+	}
+	deps := make([]spdl.Dep, 0, len(plan))
+	for _, item := range plan {
+		dep, err := spdl.ParseDep(item.pkg())
+		if err != nil {
+			return err
+		}
+		dep.Flags = item.dep.Flags
+		deps = append(deps, dep)
+	}
+
+	if len(runPlanHooks(plan, runner, hooks.PreInstall)) > 0 {
+		return fmt.Errorf("Refusing to continue after failed pre_install hooks")
+	}
+	//Dependencies are already part of the plan, letting libspack resolve more would install unchecked spakgs
+	err := libspack.Wield(deps, root, opts.reinstall, true, crunch.InstallConvenient)
+	if err == nil {
+		storePlanHooks(plan, root)
+		recordSonames(plan, root)
+	}
+	return err
+}
+
+// Runs the post_install hooks of the installed plan and any held back until it was installed
+func finishPlan(plan []*planItem, runner *hooks.Runner) []error {
+	failures := runPlanHooks(plan, runner, hooks.PostInstall)
+	return append(failures, runner.Finish()...)
+}
+
+// Wields deps into root through a checked plan, for installs that are not themselves the user's request
+func wieldChecked(deps []spdl.Dep, root string, opts wieldOptions) error {
+	plan, err := preparePlan(deps, root, opts)
+	if err != nil {
+		return err
+	}
+	runner := hooks.NewRunner(root)
+	err = installPlan(plan, root, opts, runner)
+	if err == nil && len(finishPlan(plan, runner)) > 0 {
+		err = fmt.Errorf("Some install hooks failed")
+	}
+	return err
+}
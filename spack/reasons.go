@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/cam72cam/go-lumberjack/log"
+	"github.com/serenitylinux/libspack/argparse"
+	"github.com/serenitylinux/libspack/misc"
+	"github.com/serenitylinux/libspack/repo"
+	"github.com/serenitylinux/spack/holds"
+)
+
+// Why each installed package is there, relative to the root it is installed in
+const reasonsFile = "var/lib/spack/reasons.json"
+
+const (
+	reasonExplicit = "explicit"
+	reasonDep      = "dep"
+)
+
+type installReasons map[string]string
+
+func loadReasons(root string) installReasons {
+	reasons := make(installReasons)
+	data, err := ioutil.ReadFile(filepath.Join(root, reasonsFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn.Format("Unable to read install reasons: %s", err)
+		}
+		return reasons
+	}
+	err = json.Unmarshal(data, &reasons)
+	if err != nil {
+		log.Warn.Format("Ignoring invalid install reasons: %s", err)
+	}
+	return reasons
+}
+
+func (reasons installReasons) save(root string) {
+	file := filepath.Join(root, reasonsFile)
+	data, err := json.MarshalIndent(reasons, "", "\t")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(file), 0755)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(file, data, 0644)
+	}
+	if err != nil {
+		log.Warn.Format("Unable to save install reasons to %s: %s", file, err)
+	}
+}
+
+func (reasons installReasons) isExplicit(name string) bool {
+	return reasons[name] != reasonDep
+}
+
+// Every package installed under root by name
+func installedPackages(root string) map[string]repo.PkgInstallSet {
+	installed := make(map[string]repo.PkgInstallSet)
+	for _, r := range repo.GetAllRepos() {
+		r.MapInstalled(root, func(p repo.PkgInstallSet) {
+			installed[p.Control.Name] = p
+		})
+	}
+	return installed
+}
+
+// Marks the requested packages explicit and anything else installed since before as a dependency
+func recordReasons(root string, before map[string]repo.PkgInstallSet, requested []string) {
+	reasons := loadReasons(root)
+	for name := range installedPackages(root) {
+		if _, existed := before[name]; !existed {
+			reasons[name] = reasonDep
+		}
+	}
+	for _, name := range requested {
+		reasons[name] = reasonExplicit
+	}
+	reasons.save(root)
+}
+
+func forgetReason(root string, name string) {
+	reasons := loadReasons(root)
+	if _, exists := reasons[name]; exists {
+		delete(reasons, name)
+		reasons.save(root)
+	}
+}
+
+// Dependencies nothing explicit, held or pinned needs anymore, each before what it depends on
+func orphans(root string) []repo.PkgInstallSet {
+	installed := installedPackages(root)
+	reasons := loadReasons(root)
+
+	required := make(map[string]bool)
+	var require func(name string)
+	require = func(name string) {
+		p, exists := installed[name]
+		if required[name] || !exists {
+			return
+		}
+		required[name] = true
+		for _, dep := range p.Control.Deps {
+			require(dep.Name)
+		}
+	}
+	h := holds.Load(root)
+	for name := range installed {
+		_, pinned := h.Pinned[name]
+		if reasons.isExplicit(name) || h.IsHeld(name) || pinned {
+			require(name)
+		}
+	}
+
+	remaining := make(map[string]bool)
+	for name := range installed {
+		if !required[name] {
+			remaining[name] = true
+		}
+	}
+
+	ordered := make([]repo.PkgInstallSet, 0, len(remaining))
+	for len(remaining) > 0 {
+		names := make([]string, 0, len(remaining))
+		for name := range remaining {
+			needed := false
+			for other := range remaining {
+				for _, dep := range installed[other].Control.Deps {
+					needed = needed || (other != name && dep.Name == name)
+				}
+			}
+			if !needed {
+				names = append(names, name)
+			}
+		}
+		//Dependency cycle, remove the rest in any order
+		if len(names) == 0 {
+			for name := range remaining {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			ordered = append(ordered, installed[name])
+			delete(remaining, name)
+		}
+	}
+	return ordered
+}
+
+func mark() {
+	argparse.SetBasename(fmt.Sprintf("%s %s [options] package(s)", os.Args[0], "mark"))
+	registerBaseDir()
+	explicitArg := argparse.RegisterBool("explicit", false, "Mark as installed explicitly")
+	depsArg := argparse.RegisterBool("deps", false, "Mark as installed as a dependency, allowing autoremove")
+	pkgs := argparse.EvalDefaultArgs()
+
+	if len(pkgs) == 0 || explicitArg.Get() == depsArg.Get() {
+		fmt.Println("Must specify package(s) and one of --explicit or --deps!")
+		argparse.Usage(2)
+	}
+
+	reason := reasonExplicit
+	if depsArg.Get() {
+		reason = reasonDep
+	}
+
+	root := Root()
+	installed := installedPackages(root)
+	reasons := loadReasons(root)
+	for _, pkg := range pkgs {
+		name, _, _ := pkgSplit(pkg)
+		if _, exists := installed[name]; !exists {
+			log.Error.Format("%s is not installed", name)
+			os.Exit(1)
+		}
+		reasons[name] = reason
+		fmt.Printf("Marked %s as %s\n", name, reason)
+	}
+	reasons.save(root)
+}
+
+func autoremove() {
+	argparse.SetBasename(fmt.Sprintf("%s %s [options]", os.Args[0], "autoremove"))
+	registerBaseDir()
+	registerYesToAllArg()
+	argparse.EvalDefaultArgs()
+
+	root := Root()
+	before := installedPackages(root)
+	list := orphans(root)
+	if len(list) == 0 {
+		fmt.Println("No packages to remove")
+		return
+	}
+
+	fmt.Println("Packages no longer required: ")
+	for _, p := range list {
+		fmt.Print(" ", p.Control.String())
+	}
+	fmt.Println()
+	if !yesAll.Get() && !misc.AskYesNo("Are you sure you want to continue?", false) {
+		return
+	}
+
+	names := make([]string, 0, len(list))
+	for _, p := range list {
+		names = append(names, p.Control.Name)
+	}
+	retained := retainSpakgs(names, root)
+
+	for _, p := range list {
+		r, err := repo.GetRepoFor(p.Control.Name)
+		if err == nil {
+			err = uninstallWithHooks(r, p.PkgInfo, root)
+		}
+		if err != nil {
+			log.Error.Format("Unable to remove %s: %s", p.Control.Name, err)
+			recordTransaction(root, "autoremove", before, retained, err)
+			os.Exit(1)
+		}
+		forgetReason(root, p.Control.Name)
+		fmt.Println("Successfully removed " + p.Control.Name)
+	}
+	recordTransaction(root, "autoremove", before, retained, nil)
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cam72cam/go-lumberjack/log"
+	"github.com/serenitylinux/libspack/argparse"
+	"github.com/serenitylinux/libspack/misc"
+	"github.com/serenitylinux/libspack/repo"
+	"github.com/serenitylinux/libspack/spakg"
+	"github.com/serenitylinux/spack/hooks"
+)
+
+// Spakgs of versions replaced or removed, kept per package so they can be rolled back to
+const previousDir = "var/cache/spack/previous"
+
+// How many retained versions of each package are kept
+const keepPrevious = 3
+
+// Keeps the cached spakg of every installed package among names, returning where each was kept
+func retainSpakgs(names []string, root string) map[string]string {
+	installed := installedPackages(root)
+	retained := make(map[string]string)
+	for _, name := range names {
+		p, exists := installed[name]
+		if !exists {
+			continue
+		}
+		r, err := repo.GetRepoFor(name)
+		if err != nil {
+			continue
+		}
+		src := r.GetSpakgOutput(p.PkgInfo)
+		dir := filepath.Join(root, previousDir, name)
+		dest := filepath.Join(dir, p.PkgInfo.String()+".spakg")
+		if !misc.PathExists(dest) {
+			if !misc.PathExists(src) {
+				log.Debug.Format("No spakg of %s to retain for rollback", p.Control.String())
+				continue
+			}
+			err = os.MkdirAll(dir, 0755)
+			if err == nil {
+				//A hard link is enough as long as the cache is not on another filesystem
+				err = os.Link(src, dest)
+				if err != nil {
+					err = copyFile(src, dest)
+				}
+			}
+			if err != nil {
+				log.Warn.Format("Unable to retain %s for rollback: %s", src, err)
+				continue
+			}
+		}
+		//The most recently retained versions are the ones kept
+		now := time.Now()
+		os.Chtimes(dest, now, now)
+		retained[name] = dest
+		prunePrevious(dir)
+	}
+	return retained
+}
+
+// Removes all but the keepPrevious most recently retained spakgs in dir
+func prunePrevious(dir string) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.spakg"))
+	if err != nil || len(files) <= keepPrevious {
+		return
+	}
+	mtimes := make(map[string]time.Time)
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			mtimes[file] = info.ModTime()
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return mtimes[files[i]].After(mtimes[files[j]])
+	})
+	for _, file := range files[keepPrevious:] {
+		log.Debug.Format("Pruning %s", file)
+		err = os.Remove(file)
+		if err != nil {
+			log.Warn.Format("Unable to prune %s: %s", file, err)
+		}
+	}
+}
+
+// The plan item reinstalling the retained spakg at file and where restoreRetained puts it in the repo cache
+func retainedItem(name string, file string) (*planItem, string, error) {
+	spkg, err := spakg.FromFile(file, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("Unable to read %s: %s", file, err)
+	}
+	c := spkg.Control
+	if found, _ := repo.GetPackageVersionIteration(name, c.Version, c.Iteration); found == nil {
+		return nil, "", fmt.Errorf("%s is no longer listed in any repo, it cannot be rolled back to", c.String())
+	}
+	r, err := repo.GetRepoFor(name)
+	if err != nil {
+		return nil, "", err
+	}
+	return &planItem{control: &c, repo: r, file: file, explicit: true}, r.GetSpakgOutput(&spkg.Pkginfo), nil
+}
+
+// Puts the retained spakg of item back into the repo cache so that libspack installs exactly that version
+func restoreRetained(item *planItem, cached string) error {
+	//A spakg forged again since under the same name is not what was installed
+	err := os.Remove(cached)
+	if err == nil || os.IsNotExist(err) {
+		err = os.Link(item.file, cached)
+		if err != nil {
+			err = copyFile(item.file, cached)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to restore %s to the cache: %s", item.file, err)
+	}
+	item.file = cached
+	return nil
+}
+
+// The changes needed to undo pkg's last upgrade, along with the prior versions of its dependencies from the same transaction
+func pkgRollback(pkg string, transactions []transaction, installed map[string]repo.PkgInstallSet) ([]pkgChange, error) {
+	name, _, _ := pkgSplit(pkg)
+	current, exists := installed[name]
+	if !exists {
+		return nil, fmt.Errorf("%s is not installed", name)
+	}
+
+	for i := len(transactions) - 1; i >= 0; i-- {
+		for _, change := range transactions[i].Changes {
+			if change.Name != name || change.After != current.Control.String() || change.Before == "" {
+				continue
+			}
+			changes := []pkgChange{change}
+			requires := forgeRequires(name, make(map[string]map[string]bool))
+			for _, other := range transactions[i].Changes {
+				if other.Name != name && other.Before != "" && requires[other.Name] {
+					changes = append(changes, other)
+				}
+			}
+			return changes, nil
+		}
+	}
+	return nil, fmt.Errorf("No previous version of %s to roll back to", current.Control.String())
+}
+
+// Orders plan so that each package is reinstalled after the others it requires
+func rollbackOrder(plan []*planItem) []*planItem {
+	requires := make(map[string]map[string]bool)
+	ordered := make([]*planItem, 0, len(plan))
+	visited := make(map[*planItem]bool)
+	var visit func(item *planItem)
+	visit = func(item *planItem) {
+		if visited[item] {
+			return
+		}
+		visited[item] = true
+		for _, other := range plan {
+			if other != item && forgeRequires(item.control.Name, requires)[other.control.Name] {
+				visit(other)
+			}
+		}
+		ordered = append(ordered, item)
+	}
+	for _, item := range plan {
+		visit(item)
+	}
+	return ordered
+}
+
+// Undoes changes, refusing if anything changed again since
+func applyRollback(changes []pkgChange, root string, opts wieldOptions) error {
+	seen := make(map[string]bool)
+	unique := make([]pkgChange, 0, len(changes))
+	for _, change := range changes {
+		if !seen[change.Name] {
+			seen[change.Name] = true
+			unique = append(unique, change)
+		}
+	}
+	changes = unique
+
+	installed := installedPackages(root)
+	plan := make([]*planItem, 0)
+	removes := make([]repo.PkgInstallSet, 0)
+	restores := make(map[*planItem]string)
+	for _, change := range changes {
+		current, exists := installed[change.Name]
+		if change.After != "" && (!exists || current.Control.String() != change.After) {
+			return fmt.Errorf("%s has changed since, expected %s", change.Name, change.After)
+		}
+		switch {
+		case change.Before == "":
+			removes = append(removes, current)
+		case change.Spakg == "" || !misc.PathExists(change.Spakg):
+			return fmt.Errorf("The spakg of %s was not retained, it cannot be rolled back to", change.Before)
+		default:
+			item, cached, err := retainedItem(change.Name, change.Spakg)
+			if err != nil {
+				return err
+			}
+			restores[item] = cached
+			plan = append(plan, item)
+		}
+	}
+	plan = rollbackOrder(plan)
+	//The retained spakgs get the same checks as any other install
+	err := checkPlan(plan, root, opts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Rolling back:")
+	for _, change := range changes {
+		switch {
+		case change.Before == "":
+			fmt.Printf("  remove %s\n", change.After)
+		case change.After == "":
+			fmt.Printf("  reinstall %s\n", change.Before)
+		default:
+			fmt.Printf("  %s -> %s\n", change.After, change.Before)
+		}
+	}
+	if !yesAll.Get() && !misc.AskYesNo("Are you sure you want to continue?", false) {
+		os.Exit(0)
+	}
+
+	names := make([]string, 0, len(changes))
+	for _, change := range changes {
+		names = append(names, change.Name)
+	}
+	before := installedPackages(root)
+	retained := retainSpakgs(names, root)
+
+	for _, item := range plan {
+		err = restoreRetained(item, restores[item])
+		if err != nil {
+			return err
+		}
+	}
+	runner := hooks.NewRunner(root)
+	err = installPlan(plan, root, opts, runner)
+	if err == nil && len(finishPlan(plan, runner)) > 0 {
+		err = fmt.Errorf("Some install hooks failed")
+	}
+	if err != nil {
+		err = fmt.Errorf("Unable to reinstall previous versions: %s", err)
+	}
+	for _, p := range removes {
+		if err != nil {
+			break
+		}
+		var r *repo.Repo
+		r, err = repo.GetRepoFor(p.Control.Name)
+		if err == nil {
+			err = uninstallWithHooks(r, p.PkgInfo, root)
+		}
+		if err == nil {
+			forgetReason(root, p.Control.Name)
+		}
+	}
+
+	recordTransaction(root, "rollback", before, retained, err)
+	return err
+}
+
+func rollback() {
+	argparse.SetBasename(fmt.Sprintf("%s %s [options] [package(s)]", os.Args[0], "rollback"))
+	registerBaseDir()
+	registerYesToAllArg()
+	registerAllowUnsignedArg()
+	registerForceArg()
+	transactionArg := argparse.RegisterString("transaction", "(not set)", "Undo a whole transaction, by id or \"last\"")
+	pkgs := argparse.EvalDefaultArgs()
+
+	if len(pkgs) == 0 && !transactionArg.IsSet() {
+		fmt.Println("Must specify package(s) or --transaction!")
+		argparse.Usage(2)
+	}
+
+	root := Root()
+	transactions := loadTransactions(root)
+	changes := make([]pkgChange, 0)
+
+	if transactionArg.IsSet() {
+		if len(transactions) == 0 {
+			log.Error.Println("No transactions recorded")
+			os.Exit(1)
+		}
+		//The last transaction that changed anything
+		var t transaction
+		for _, other := range transactions {
+			if len(other.Changes) > 0 {
+				t = other
+			}
+		}
+		if transactionArg.Get() != "last" {
+			id, err := strconv.Atoi(transactionArg.Get())
+			found := false
+			for _, other := range transactions {
+				if err == nil && other.Id == id {
+					t = other
+					found = true
+				}
+			}
+			if !found {
+				log.Error.Format("No transaction %s", transactionArg.Get())
+				os.Exit(1)
+			}
+		}
+		changes = append(changes, t.Changes...)
+	}
+
+	installed := installedPackages(root)
+	for _, pkg := range pkgs {
+		pkgChanges, err := pkgRollback(pkg, transactions, installed)
+		if err != nil {
+			log.Error.Println(err)
+			os.Exit(1)
+		}
+		changes = append(changes, pkgChanges...)
+	}
+
+	if len(changes) == 0 {
+		log.Info.Println("Nothing to roll back")
+		return
+	}
+
+	opts := wieldOptions{allowUnsigned: allowUnsignedArg.Get(), force: forceArg.Get()}
+	err := applyRollback(changes, root, opts)
+	if err != nil {
+		log.Error.Println(err)
+		os.Exit(1)
+	}
+	misc.PrintSuccess()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/cam72cam/go-lumberjack/log"
+	"github.com/serenitylinux/spack/sign"
+	"github.com/serenitylinux/spack/soname"
+)
+
+// libspack drops pkginfo fields it does not know, so installed sonames are kept here, relative to the root
+const sonamesFile = "var/lib/spack/sonames.json"
+
+func loadSonames(root string) map[string]soname.Set {
+	sonames := make(map[string]soname.Set)
+	data, err := ioutil.ReadFile(filepath.Join(root, sonamesFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn.Format("Unable to read installed sonames: %s", err)
+		}
+		return sonames
+	}
+	err = json.Unmarshal(data, &sonames)
+	if err != nil {
+		log.Warn.Format("Ignoring invalid installed sonames: %s", err)
+	}
+	return sonames
+}
+
+// Sonames of the plan's spakgs by package name, falling back to the file names they contain
+func planSonames(plan []*planItem) (map[string]soname.Set, error) {
+	sonames := make(map[string]soname.Set)
+	for _, item := range plan {
+		s, err := soname.FromEntries(item.entries)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read the sonames of %s: %s", item.control.String(), err)
+		}
+		if s == nil {
+			sums, err := sign.Sums(item.entries)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to read %s: %s", item.file, err)
+			}
+			s = &soname.Set{}
+			for f := range sums {
+				s.Provided = append(s.Provided, path.Base(f))
+			}
+		}
+		sonames[item.control.Name] = *s
+	}
+	return sonames, nil
+}
+
+// Sonames of the packages installed under root, falling back to their file names
+func installedSonames(root string) map[string]soname.Set {
+	recorded := loadSonames(root)
+	sonames := make(map[string]soname.Set)
+	for name, p := range installedPackages(root) {
+		if s, exists := recorded[name]; exists {
+			sonames[name] = s
+			continue
+		}
+		s := soname.Set{}
+		for f := range p.Hashes {
+			s.Provided = append(s.Provided, path.Base(f))
+		}
+		sonames[name] = s
+	}
+	return sonames
+}
+
+func providedBy(sets ...map[string]soname.Set) map[string]bool {
+	provided := make(map[string]bool)
+	for _, set := range sets {
+		for _, s := range set {
+			for _, lib := range s.Provided {
+				provided[lib] = true
+			}
+		}
+	}
+	return provided
+}
+
+// Shared libraries that would be missing for the plan's or the installed packages once plan is installed
+func sonameProblems(plan []*planItem, root string) ([]string, error) {
+	planned, err := planSonames(plan)
+	if err != nil {
+		return nil, err
+	}
+	installed := installedSonames(root)
+	before := providedBy(installed)
+
+	kept := make(map[string]soname.Set)
+	for name, s := range installed {
+		if _, replaced := planned[name]; !replaced {
+			kept[name] = s
+		}
+	}
+	after := providedBy(kept, planned)
+
+	problems := make([]string, 0)
+	for _, item := range plan {
+		for _, lib := range planned[item.control.Name].Needed {
+			if !after[lib] {
+				problems = append(problems, fmt.Sprintf("%s needs %s, which no installed or planned package provides", item.control.String(), lib))
+			}
+		}
+	}
+	for name, s := range kept {
+		for _, lib := range s.Needed {
+			//Only report what the plan breaks, not what was already missing
+			if before[lib] && !after[lib] {
+				problems = append(problems, fmt.Sprintf("%s needs %s, which the planned packages no longer provide", name, lib))
+			}
+		}
+	}
+	return problems, nil
+}
+
+// Refuses plans that would leave shared libraries unresolved, unless forced
+func checkSonames(plan []*planItem, root string, force bool) error {
+	problems, err := sonameProblems(plan, root)
+	if err != nil {
+		return err
+	}
+	for _, problem := range problems {
+		if force {
+			log.Warn.Println(problem)
+		} else {
+			log.Error.Println(problem)
+		}
+	}
+	if len(problems) > 0 && !force {
+		return fmt.Errorf("Refusing to install packages with missing shared libraries, use --force to override")
+	}
+	return nil
+}
+
+// Records the sonames of the installed plan for later checks
+func recordSonames(plan []*planItem, root string) {
+	planned, err := planSonames(plan)
+	if err != nil {
+		log.Warn.Println(err)
+		return
+	}
+	sonames := loadSonames(root)
+	for name, s := range planned {
+		sonames[name] = s
+	}
+
+	file := filepath.Join(root, sonamesFile)
+	data, err := json.MarshalIndent(sonames, "", "\t")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(file), 0755)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(file, data, 0644)
+	}
+	if err != nil {
+		log.Warn.Format("Unable to save installed sonames to %s: %s", file, err)
+	}
+}
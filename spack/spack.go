@@ -4,18 +4,20 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/cam72cam/go-lumberjack/color"
 	"github.com/cam72cam/go-lumberjack/log"
-	"github.com/serenitylinux/libspack"
 	"github.com/serenitylinux/libspack/argparse"
 	"github.com/serenitylinux/libspack/control"
-	"github.com/serenitylinux/libspack/crunch"
 	"github.com/serenitylinux/libspack/misc"
 	"github.com/serenitylinux/libspack/repo"
 	"github.com/serenitylinux/libspack/spdl"
+	"github.com/serenitylinux/spack/holds"
+	"github.com/serenitylinux/spack/hooks"
 )
 
 import . "github.com/serenitylinux/libspack/misc"
@@ -38,6 +40,16 @@ Commands:
   packages          Prints pacakges in repo (default all repos)
   news              Print news for package(s)
   audit             Prints audit information about a package
+  lint              Checks template(s) or repo dir(s) for problems
+  owns              Prints which package owns a file
+  config-merge      Resolves config files left as .spacknew by upgrades
+  keygen            Creates a key pair for signing forged packages
+  mark              Marks package(s) as explicitly installed or as dependencies
+  autoremove        Removes dependencies no longer required by anything
+  hold              Stops package(s) from being reinstalled or upgraded
+  pin               Keeps package(s) at a version, as package::version
+  rollback          Reinstalls the previous version of package(s) or a transaction
+  history           Prints the transaction log
 
   --help            This help page
 	
@@ -105,6 +117,24 @@ func registerInteractiveArg() {
 	interactiveArg = argparse.RegisterBool("interactive", false, "Drop to shell in directory of failed build")
 }
 
+var signKeyArg *argparse.StringValue = nil
+
+func registerSignKeyArg() {
+	signKeyArg = argparse.RegisterString("sign-key", "(not set)", "Sign the forged spakgs with this key, see spack keygen")
+}
+
+var keepGoingArg *argparse.BoolValue = nil
+
+func registerKeepGoingArg() {
+	keepGoingArg = argparse.RegisterBool("keep-going", false, "Continue forging packages that do not depend on a failed one")
+}
+
+var resumeArg *argparse.BoolValue = nil
+
+func registerResumeArg() {
+	resumeArg = argparse.RegisterBool("resume", false, "Skip packages already forged by the previous interrupted run")
+}
+
 var nameArg *argparse.BoolValue = nil
 
 func registerNameArg() {
@@ -176,11 +206,38 @@ func forge(pkgs []string) {
 		deps = append(deps, dep)
 	}
 
-	err := libspack.Forge(deps, Root(), noBDepsArg.Get(), buildLocalArg.Get())
-	if err != nil {
-		log.Error.Format(err.Error())
+	outdir := ""
+	if forgeoutdirArg.IsSet() {
+		var err error
+		outdir, err = filepath.Abs(forgeoutdirArg.Get())
+		if err == nil {
+			err = os.MkdirAll(outdir, 0755)
+		}
+		if err != nil {
+			log.Error.Format("Invalid outdir %s: %s", forgeoutdirArg.Get(), err)
+			os.Exit(1)
+		}
+	}
+
+	//Held packages may still be forged, only installing them is refused
+	h := holds.Load(Root())
+	for _, dep := range deps {
+		_, _, err := resolvePinned(dep, h)
+		if err != nil {
+			log.Error.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	before := installedPackages(Root())
+	ok := forgeEach(pkgs, deps, outdir, keepGoingArg.Get(), resumeArg.Get())
+	//Bdeps installed to build with are only there as dependencies
+	recordReasons(Root(), before, nil)
+	if !ok {
+		recordTransaction(Root(), "forge", before, nil, fmt.Errorf("Some packages failed to forge"))
 		os.Exit(1)
 	}
+	recordTransaction(Root(), "forge", before, nil, nil)
 	PrintSuccess()
 }
 
@@ -197,11 +254,51 @@ func wield(pkgs []string) {
 		deps = append(deps, dep)
 	}
 
-	err := libspack.Wield(deps, Root(), reinstallArg.Get(), noDepsArg.Get(), crunch.InstallConvenient)
+	opts := wieldOptions{
+		withDeps:      !noDepsArg.Get(),
+		reinstall:     reinstallArg.Get(),
+		allowUnsigned: allowUnsignedArg.Get(),
+		force:         forceArg.Get(),
+		honorHolds:    true,
+	}
+	names := make([]string, 0, len(deps))
+	for _, dep := range deps {
+		names = append(names, dep.Name)
+	}
+	wieldPlan("wield", deps, names, opts)
+}
+
+// Installs deps into the root as action in the history, marking explicit as explicitly installed
+func wieldPlan(action string, deps []spdl.Dep, explicit []string, opts wieldOptions) {
+	//Every spakg is fetched and checked before anything is installed
+	plan, err := preparePlan(deps, Root(), opts)
+	if err != nil {
+		log.Error.Println(err)
+		os.Exit(1)
+	}
+	configs := modifiedConfigs(Root())
+
+	before := installedPackages(Root())
+	retained := retainSpakgs(planNames(plan), Root())
+	runner := hooks.NewRunner(Root())
+	err = installPlan(plan, Root(), opts, runner)
+	protectConfigs(configs)
+	recordTransaction(Root(), action, before, retained, err)
 	if err != nil {
 		log.Error.Format(err.Error())
 		os.Exit(1)
 	}
+
+	hookFailures := finishPlan(plan, runner)
+
+	recordReasons(Root(), before, explicit)
+	if len(hookFailures) > 0 {
+		log.Error.Println("Some install hooks failed:")
+		for _, err := range hookFailures {
+			log.Error.Println("  " + err.Error())
+		}
+		os.Exit(1)
+	}
 	PrintSuccess()
 }
 
@@ -233,8 +330,11 @@ func getPkg(pkg string) (*control.Control, *repo.Repo) {
 func list() {
 	installed := false
 	installedArg := argparse.RegisterBool("installed", installed, "Show only packages that are installed")
+	explicitArg := argparse.RegisterBool("explicit", false, "Show only packages installed explicitly, implies --installed")
+	depsArg := argparse.RegisterBool("deps", false, "Show only packages installed as dependencies, implies --installed")
 	repos_list := argparse.EvalDefaultArgs()
-	installed = installedArg.Get()
+	installed = installedArg.Get() || explicitArg.Get() || depsArg.Get()
+	reasons := loadReasons("/")
 
 	repos := repo.GetAllRepos()
 
@@ -243,6 +343,10 @@ func list() {
 		r := repos[repoName]
 		if installed {
 			r.MapInstalled("/", func(p repo.PkgInstallSet) {
+				explicit := reasons.isExplicit(p.Control.Name)
+				if (explicitArg.Get() && !explicit) || (depsArg.Get() && explicit) {
+					return
+				}
 				fmt.Println(p.Control.String())
 			})
 		} else {
@@ -307,18 +411,23 @@ func purge() {
 	registerBaseDir()
 	pkgs := argparse.EvalDefaultArgs()
 	if len(pkgs) >= 1 {
-		remove(pkgs)
+		before := installedPackages(Root())
+		retained, err := remove(pkgs)
+		recordTransaction(Root(), "remove", before, retained, err)
 	} else {
 		log.Error.Println("Must specify package(s) for information")
 		argparse.Usage(2)
 	}
 }
 
-func remove(pkgs []string) {
+// Removes pkgs and whatever depends on them, returning the spakgs retained to undo it and the last error
+func remove(pkgs []string) (map[string]string, error) {
 	if verboseArg.Get() {
 		log.SetLevel(log.DebugLevel)
 	}
 
+	retained := make(map[string]string)
+	var lastErr error
 	for _, pkg := range pkgs {
 		control, repo := getPkg(pkg)
 		if control == nil {
@@ -345,6 +454,14 @@ func remove(pkgs []string) {
 			fmt.Println()
 		}
 		if AskYesNo("Are you sure you want to continue?", false) {
+			names := []string{control.Name}
+			for _, rdep := range list {
+				names = append(names, rdep.Control.Name)
+			}
+			for name, file := range retainSpakgs(names, Root()) {
+				retained[name] = file
+			}
+
 			var err error
 			for _, rdep := range list {
 				//Edge case
@@ -353,54 +470,84 @@ func remove(pkgs []string) {
 					continue
 				}
 
-				err = repo.Uninstall(rdep.PkgInfo, destdirArg.Get())
+				err = uninstallWithHooks(repo, rdep.PkgInfo, destdirArg.Get())
 				if err != nil {
 					log.Error.Println("Unable to remove " + rdep.Control.Name)
 					log.Warn.Println(err)
+					lastErr = err
 					break
 				} else {
+					forgetReason(destdirArg.Get(), rdep.Control.Name)
 					fmt.Println("Successfully removed " + rdep.Control.Name)
 				}
 			}
 			if err == nil {
-				err = repo.Uninstall(pkgset.PkgInfo, destdirArg.Get())
+				err = uninstallWithHooks(repo, pkgset.PkgInfo, destdirArg.Get())
 				if err != nil {
 					log.Warn.Println(err)
+					lastErr = err
 					continue
 				}
+				forgetReason(destdirArg.Get(), control.Name)
 			}
 			fmt.Println("Successfully removed " + pkg)
 		}
 	}
+	return retained, lastErr
 }
 
 func upgrade() {
-	/*
-		argparse.SetBasename(fmt.Sprintf("%s %s [options]", os.Args[0], "upgrade"))
-		pkgs := ForgeWieldArgs(false)
+	argparse.SetBasename(fmt.Sprintf("%s %s [options]", os.Args[0], "upgrade"))
+	registerForceArg()
+	registerAllowUnsignedArg()
+	pkgs := ForgeWieldArgs(false)
 
-		if len(pkgs) > 0 {
-			log.Error.Format("Invalid options: ", pkgs)
-			argparse.Usage(2)
-		}
+	if len(pkgs) > 0 {
+		log.Error.Format("Invalid options: %s", pkgs)
+		argparse.Usage(2)
+	}
 
-		nameList := make([]string, 0)
-		for _, repo := range repo.GetAllRepos() {
-			for _, pkg := range repo.GetAllInstalled() {
-				c, _ := repo.GetLatestControl(pkg.Control.Name)
-				if c != nil && c.String() > pkg.Control.String() {
-					nameList = append(nameList, c.Name)
-					log.Debug.Format("%s, %s > %s", repo.Name, c.String(), pkg.Control.String())
-				}
-			}
+	//Pinned packages move to their pin, held ones stay where they are
+	h := holds.Load(Root())
+	names := make([]string, 0)
+	upgrades := make([]spdl.Dep, 0)
+	targets := make(map[string]string)
+	installed := installedPackages(Root())
+	for name, p := range installed {
+		if h.IsHeld(name) {
+			log.Debug.Format("%s is held, not upgrading", name)
+			continue
+		}
+		c, _, err := resolvePinned(spdl.Dep{Name: name}, h)
+		if err != nil {
+			log.Error.Println(err)
+			os.Exit(1)
+		}
+		if c.String() != p.Control.String() {
+			names = append(names, name)
+			targets[name] = c.String()
 		}
+	}
+	sort.Strings(names)
 
-		if len(nameList) > 0 {
-			fmt.Println("The following packages will be upgraded: ")
-			forgewieldPackages(nameList, false)
-		} else {
-			fmt.Println("No packages to upgrade (Horay!)")
-		}*/
+	if len(names) == 0 {
+		fmt.Println("No packages to upgrade (Horay!)")
+		return
+	}
+	fmt.Println("The following packages will be upgraded: ")
+	for _, name := range names {
+		fmt.Printf("  %s -> %s\n", installed[name].Control.String(), targets[name])
+		upgrades = append(upgrades, spdl.Dep{Name: name})
+	}
+
+	opts := wieldOptions{
+		withDeps:      !noDepsArg.Get(),
+		allowUnsigned: allowUnsignedArg.Get(),
+		force:         forceArg.Get(),
+		honorHolds:    true,
+	}
+	//Upgrading does not change why a package is installed
+	wieldPlan("upgrade", upgrades, nil, opts)
 }
 
 func refresh() {
@@ -536,6 +683,10 @@ func main() {
 		argparse.SetBasename(fmt.Sprintf("%s %s [options] package(s)", os.Args[0], command))
 		registerForgeOutDirArg()
 		registerInteractiveArg()
+		registerKeepGoingArg()
+		registerResumeArg()
+		registerSignKeyArg()
+		registerAllowUnsignedArg()
 		forge(ForgeWieldArgs(true))
 
 	case "install":
@@ -543,6 +694,8 @@ func main() {
 	case "wield":
 		argparse.SetBasename(fmt.Sprintf("%s %s [options] package(s)", os.Args[0], command))
 		registerReinstallArg()
+		registerForceArg()
+		registerAllowUnsignedArg()
 		wield(ForgeWieldArgs(true))
 
 	case "purge":
@@ -565,6 +718,26 @@ func main() {
 		list()
 	case "search":
 		search()
+	case "lint":
+		lint()
+	case "owns":
+		owns()
+	case "config-merge":
+		configMerge()
+	case "keygen":
+		keygen()
+	case "mark":
+		mark()
+	case "autoremove":
+		autoremove()
+	case "hold":
+		hold()
+	case "pin":
+		pin()
+	case "rollback":
+		rollback()
+	case "history":
+		history()
 	case "info":
 		if len(os.Args) > 1 {
 			info(os.Args[1:])
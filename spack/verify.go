@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cam72cam/go-lumberjack/log"
+	"github.com/serenitylinux/libspack/argparse"
+	"github.com/serenitylinux/spack/sign"
+)
+
+var allowUnsignedArg *argparse.BoolValue = nil
+
+func registerAllowUnsignedArg() {
+	allowUnsignedArg = argparse.RegisterBool("allow-unsigned", false, "Install packages not signed by a key in "+sign.KeysDir)
+}
+
+// Refuses a tampered spakg in plan, or an untrusted one not forged by this run unless allowUnsigned
+func verifyPlan(plan []*planItem, allowUnsigned bool) error {
+	keys, err := sign.LoadKeyring(sign.KeysDir)
+	if err != nil {
+		return fmt.Errorf("Unable to load keyring: %s", err)
+	}
+
+	for _, item := range plan {
+		item.entries, err = sign.ReadEntries(item.file)
+		if err != nil {
+			return fmt.Errorf("Unable to read %s: %s", item.file, err)
+		}
+		signer, err := sign.VerifyEntries(item.file, item.entries, keys)
+		_, untrusted := err.(sign.UntrustedError)
+		switch {
+		case untrusted && item.forged:
+			log.Debug.Format("%s was forged locally: %s", item.control.String(), err)
+		case untrusted && allowUnsigned:
+			log.Warn.Println(err)
+		case untrusted:
+			return fmt.Errorf("%s, use --allow-unsigned to install it anyway", err)
+		case err != nil:
+			return err
+		default:
+			log.Debug.Format("%s is signed by %s", item.control.String(), signer)
+		}
+	}
+	return nil
+}
+
+// Writes a new signing key pair as <name>.key and <name>.pub, for forge --sign-key and /etc/spack/keys
+func keygen() {
+	argparse.SetBasename(fmt.Sprintf("%s %s [options] name", os.Args[0], "keygen"))
+	names := argparse.EvalDefaultArgs()
+	if len(names) != 1 {
+		fmt.Println("Must specify a key name!")
+		argparse.Usage(2)
+	}
+	name := names[0]
+
+	err := sign.WriteKeyPair(name)
+	if err != nil {
+		log.Error.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("Wrote %s.key and %s.pub, install %s.pub in %s to trust packages signed with it\n", name, name, name, sign.KeysDir)
+}
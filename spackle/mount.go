@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/cam72cam/go-lumberjack/log"
+	"github.com/serenitylinux/libspack/misc"
+)
+
+// Everything mounted by spackle, in the order it was mounted
+var mounts = make([]string, 0)
+var mountsLock sync.Mutex
+
+// Temporary directories to remove once everything is unmounted
+var tempDirs = make([]string, 0)
+
+var cleanupOnce sync.Once
+
+func Mount(target string, args ...string) error {
+	mountsLock.Lock()
+	defer mountsLock.Unlock()
+
+	args = append(args, target)
+	err := misc.RunCommandToStdOutErr(exec.Command("mount", args...))
+	if err != nil {
+		return err
+	}
+	mounts = append(mounts, target)
+	return nil
+}
+
+func UnmountAll() {
+	mountsLock.Lock()
+	defer mountsLock.Unlock()
+
+	//Unwind in reverse so nested mounts go first
+	for i := len(mounts) - 1; i >= 0; i-- {
+		log.Debug.Format("Unmounting %s", mounts[i])
+		err := misc.RunCommandToStdOutErr(exec.Command("umount", "--recursive", "--lazy", mounts[i]))
+		if err != nil {
+			log.Warn.Format("Unable to unmount %s: %s", mounts[i], err)
+		}
+	}
+	mounts = mounts[:0]
+}
+
+func Cleanup() {
+	//Once blocks concurrent callers until the first cleanup has finished
+	cleanupOnce.Do(func() {
+		UnmountAll()
+		for _, dir := range tempDirs {
+			err := os.Remove(dir)
+			if err != nil {
+				log.Warn.Format("Unable to remove %s: %s", dir, err)
+			}
+		}
+	})
+}
+
+func Fail(format string, args ...interface{}) {
+	log.Error.Format(format, args...)
+	Cleanup()
+	os.Exit(-1)
+}
+
+func HandleSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		sig := <-sigs
+		RestoreEcho()
+		log.Warn.Format("Caught %s, cleaning up", sig)
+		Cleanup()
+		os.Exit(-1)
+	}()
+}
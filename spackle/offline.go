@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cam72cam/go-lumberjack/log"
+	"github.com/serenitylinux/libspack/control"
+	"github.com/serenitylinux/libspack/misc"
+	"github.com/serenitylinux/libspack/pkginfo"
+	"github.com/serenitylinux/libspack/repo"
+	"github.com/serenitylinux/spack/sign"
+)
+
+// A prebuilt spakg from an installation medium laid out like smithy's outdir:
+// <cache>/<repo>/info/*.{control,pkginfo} and <cache>/<repo>/pkgs/*.spakg
+type LocalPkg struct {
+	Control control.Control
+	PkgInfo pkginfo.PkgInfo
+	File    string
+	Repo    string
+}
+
+// Every spakg on the medium, by the exact version and iteration it holds
+type LocalCache map[string]*LocalPkg
+
+func decodeFile(file string, v interface{}) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func localKey(name, version string, iteration int) string {
+	return fmt.Sprintf("%s::%s::%d", name, version, iteration)
+}
+
+func LoadLocalCache(dir string) (LocalCache, error) {
+	infodirs, err := filepath.Glob(filepath.Join(dir, "*", "info"))
+	if err != nil {
+		return nil, err
+	}
+	if len(infodirs) == 0 {
+		return nil, fmt.Errorf("No repository info found in %s", dir)
+	}
+
+	cache := make(LocalCache)
+	for _, infodir := range infodirs {
+		pkgdir := filepath.Join(filepath.Dir(infodir), "pkgs")
+
+		controlFiles, _ := filepath.Glob(filepath.Join(infodir, "*.control"))
+		controls := make(map[string]control.Control)
+		for _, file := range controlFiles {
+			var c control.Control
+			err := decodeFile(file, &c)
+			if err != nil {
+				log.Warn.Format("Skipping invalid control %s: %s", file, err)
+				continue
+			}
+			controls[localKey(c.Name, c.Version, c.Iteration)] = c
+		}
+
+		pkginfoFiles, _ := filepath.Glob(filepath.Join(infodir, "*.pkginfo"))
+		for _, file := range pkginfoFiles {
+			var pi pkginfo.PkgInfo
+			err := decodeFile(file, &pi)
+			if err != nil {
+				log.Warn.Format("Skipping invalid pkginfo %s: %s", file, err)
+				continue
+			}
+
+			c, exists := controls[localKey(pi.Name, pi.Version, pi.Iteration)]
+			if !exists {
+				log.Warn.Format("Skipping %s, no matching control", file)
+				continue
+			}
+
+			spakg := filepath.Join(pkgdir, strings.TrimSuffix(filepath.Base(file), ".pkginfo")+".spakg")
+			if !misc.PathExists(spakg) {
+				log.Warn.Format("Skipping %s, %s is missing", file, spakg)
+				continue
+			}
+
+			cache[localKey(c.Name, c.Version, c.Iteration)] = &LocalPkg{Control: c, PkgInfo: pi, File: spakg, Repo: filepath.Base(filepath.Dir(infodir))}
+		}
+	}
+	return cache, nil
+}
+
+// The intact spakgs on the medium without a trusted signature, a tampered one is an error
+func (cache LocalCache) Unsigned() ([]string, error) {
+	keys, err := sign.LoadKeyring(sign.KeysDir)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load keyring: %s", err)
+	}
+
+	unsigned := make([]string, 0)
+	for _, pkg := range cache {
+		_, err := sign.Verify(pkg.File, keys)
+		if _, untrusted := err.(sign.UntrustedError); untrusted {
+			unsigned = append(unsigned, pkg.Control.String())
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(unsigned)
+	return unsigned, nil
+}
+
+// Puts the spakgs on the medium into their repo's cache, where spack looks before fetching
+func (cache LocalCache) Seed() error {
+	err := repo.LoadRepos()
+	if err != nil {
+		return err
+	}
+	repos := repo.GetAllRepos()
+	for _, pkg := range cache {
+		r, exists := repos[pkg.Repo]
+		if !exists {
+			return fmt.Errorf("%s is from repo %s, which is not configured", pkg.File, pkg.Repo)
+		}
+		dest := r.GetSpakgOutput(&pkg.PkgInfo)
+		if misc.PathExists(dest) {
+			continue
+		}
+		err = os.MkdirAll(filepath.Dir(dest), 0755)
+		if err == nil {
+			//A hard link is enough as long as the medium is not on another filesystem
+			err = os.Link(pkg.File, dest)
+			if err != nil {
+				err = misc.RunCommandToStdOutErr(exec.Command("cp", pkg.File, dest))
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to add %s to the repo cache: %s", pkg.File, err)
+		}
+	}
+	return nil
+}
+
+// Installs packages with spack, exactly like an online install, from the spakgs on the medium instead of the network
+func InstallOffline(dir string, cacheDir string, packages []string, allowUnsigned bool) error {
+	cache, err := LoadLocalCache(cacheDir)
+	if err == nil {
+		err = cache.Seed()
+	}
+	if err != nil {
+		return err
+	}
+
+	args := []string{}
+	if allowUnsigned {
+		args = append(args, "--allow-unsigned")
+	}
+	return InstallTo(dir, packages, args...)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/cam72cam/go-lumberjack/log"
+)
+
+const minPasswordLength = 8
+
+// Long passphrases are accepted regardless of character classes
+const passphraseLength = 16
+
+var cryptRgx = regexp.MustCompile(`^\$(1|2[aby]|5|6|y)\$[./A-Za-z0-9$=,]+$`)
+
+var echoDisabled = false
+
+func setEcho(on bool) {
+	mode := "-echo"
+	if on {
+		mode = "echo"
+	}
+	cmd := exec.Command("stty", mode)
+	cmd.Stdin = os.Stdin
+	err := cmd.Run()
+	if err != nil {
+		log.Debug.Format("Unable to set terminal %s: %s", mode, err)
+		return
+	}
+	echoDisabled = !on
+}
+
+func RestoreEcho() {
+	if echoDisabled {
+		setEcho(true)
+	}
+}
+
+func ReadSecret(prompt string) string {
+	fmt.Print(prompt + ": ")
+	setEcho(false)
+	defer RestoreEcho()
+	secret := ReadLine()
+	fmt.Println()
+	return secret
+}
+
+func CheckPassword(pass string) error {
+	if len(pass) < minPasswordLength {
+		return fmt.Errorf("Password must be at least %d characters", minPasswordLength)
+	}
+
+	classes := []func(rune) bool{unicode.IsLower, unicode.IsUpper, unicode.IsDigit, func(r rune) bool {
+		return unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r)
+	}}
+	found := 0
+	for _, class := range classes {
+		if strings.IndexFunc(pass, class) != -1 {
+			found++
+		}
+	}
+
+	if found < 3 && len(pass) < passphraseLength {
+		return fmt.Errorf("Password must contain at least three of lowercase, uppercase, digits and symbols, or be at least %d characters", passphraseLength)
+	}
+	return nil
+}
+
+func CheckHash(hash string) error {
+	if !cryptRgx.MatchString(hash) {
+		return errors.New("Not a valid crypt(3) hash, expected something like $6$salt$hash")
+	}
+	return nil
+}
+
+// Returns the root password, or its crypt(3) hash if hashed is set
+func AskRootPassword() (secret string, hashed bool) {
+	if AskYesNo("Do you wish to provide a pre-hashed root password?", false) {
+		for {
+			hash := ReadSecret("Root password hash")
+			err := CheckHash(hash)
+			if err == nil {
+				return hash, true
+			}
+			log.Error.Println(err)
+		}
+	}
+
+	for {
+		pass := ReadSecret("Please choose a root password")
+		err := CheckPassword(pass)
+		if err != nil {
+			log.Error.Println(err)
+			continue
+		}
+
+		if ReadSecret("Confirm root password") != pass {
+			log.Error.Println("Passwords do not match")
+			continue
+		}
+		return pass, false
+	}
+}
+
+func SetRootPass(dir, secret string, hashed bool) error {
+	args := []string{dir, "chpasswd"}
+	if hashed {
+		args = append(args, "--encrypted")
+	}
+
+	cmd := exec.Command("chroot", args...)
+	cmd.Stdin = strings.NewReader("root:" + secret + "\n")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
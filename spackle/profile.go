@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/cam72cam/go-lumberjack/log"
+)
+
+const profilesFile = "/etc/spack/profiles.json"
+
+type Profile struct {
+	Name        string
+	Description string
+	Packages    []string
+}
+
+var stdin = bufio.NewReader(os.Stdin)
+
+func ReadLine() string {
+	line, _ := stdin.ReadString('\n')
+	return strings.TrimSpace(line)
+}
+
+func LoadProfiles() ([]Profile, error) {
+	data, err := ioutil.ReadFile(profilesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var profiles []Profile
+	err = json.Unmarshal(data, &profiles)
+	return profiles, err
+}
+
+func SelectProfiles(profiles []Profile) []Profile {
+	log.Info.Println("Please select one or more profiles to install (space separated):")
+	for i, profile := range profiles {
+		log.Debug.Format("%d: %s (%s)", i+1, profile.Name, profile.Description)
+	}
+
+	answer := ReadLine()
+	if answer == "" {
+		log.Error.Println("At least one profile is required")
+		return SelectProfiles(profiles)
+	}
+
+	selected := make([]Profile, 0)
+	for _, field := range strings.Fields(answer) {
+		i, err := strconv.Atoi(field)
+		if err != nil || i < 1 || i > len(profiles) {
+			log.Error.Format("Invalid Selection: %s", field)
+			return SelectProfiles(profiles)
+		}
+		selected = append(selected, profiles[i-1])
+	}
+	return selected
+}
+
+func AskExtraPackages() []string {
+	log.Info.Println("Additional packages to install (space separated, blank for none):")
+	return strings.Fields(ReadLine())
+}
+
+// Merges the packages of every profile and extras, dropping duplicates but keeping order
+func PackageList(profiles []Profile, extra []string) []string {
+	seen := make(map[string]bool)
+	packages := make([]string, 0)
+
+	add := func(pkg string) {
+		if !seen[pkg] {
+			seen[pkg] = true
+			packages = append(packages, pkg)
+		}
+	}
+
+	for _, profile := range profiles {
+		for _, pkg := range profile.Packages {
+			add(pkg)
+		}
+	}
+	for _, pkg := range extra {
+		add(pkg)
+	}
+	return packages
+}
@@ -3,11 +3,15 @@ package main
 import (
 	"fmt"
 	"github.com/cam72cam/go-lumberjack/log"
+	"github.com/serenitylinux/libspack/argparse"
 	"github.com/serenitylinux/libspack/misc"
+	"github.com/serenitylinux/spack/sign"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -18,8 +22,7 @@ func AskYesNo(question string, def bool) bool {
 	}
 	fmt.Printf("%s: %s ", question, yn)
 
-	var answer string
-	fmt.Scanf("%s", &answer)
+	answer := ReadLine()
 
 	yesRgx := regexp.MustCompile("(y|Y|yes|Yes)")
 	noRgx := regexp.MustCompile("(n|N|no|No)")
@@ -36,20 +39,6 @@ func AskYesNo(question string, def bool) bool {
 	}
 }
 
-func AskQuestion(question string) string {
-	log.Info.Println(question)
-	var answer string
-	fmt.Scanf("%s", &answer)
-
-	answer = strings.TrimSpace(answer)
-	if len(answer) > 4 {
-		return answer
-	} else {
-		log.Error.Println("Password must be longer than 4 chars")
-		return AskQuestion(question)
-	}
-}
-
 func RequireRoot() {
 	if os.Geteuid() != 0 {
 		log.Error.Println("Must be root")
@@ -126,8 +115,7 @@ func SelectDevice() Device {
 		log.Debug.Format("%d: %s (%s) %s", i+1, device.file, device.label, device.fstype)
 	}
 
-	var answer int
-	fmt.Scanf("%d", &answer)
+	answer, _ := strconv.Atoi(ReadLine())
 	if answer > 0 && answer <= len(devices) {
 		answer--
 		return devices[answer]
@@ -137,83 +125,86 @@ func SelectDevice() Device {
 	}
 }
 
-func FormatDevice(device Device) {
-	err := misc.RunCommandToStdOutErr(exec.Command("mkfs.ext4", device.file))
+func FormatDevice(device Device) error {
+	return misc.RunCommandToStdOutErr(exec.Command("mkfs.ext4", device.file))
+}
+
+func MountDevice(device Device) (string, error) {
+	dir, err := ioutil.TempDir(os.TempDir(), "spackle")
 	if err != nil {
-		log.Error.Println("Unable to create fs")
-		os.Exit(-1)
+		return "", err
 	}
-}
+	tempDirs = append(tempDirs, dir)
 
-func MountDevice(device Device) string {
-	dir, _ := ioutil.TempDir(os.TempDir(), "spackle")
-	os.MkdirAll(dir, 755)
-	err := misc.RunCommandToStdOutErr(exec.Command("mount", device.file, dir))
+	err = os.MkdirAll(dir, 0755)
 	if err != nil {
-		log.Error.Println("Unable to mount")
-		os.Exit(-1)
+		return "", err
 	}
-	return dir + "/"
+
+	err = Mount(dir, device.file)
+	if err != nil {
+		return "", err
+	}
+	return dir + "/", nil
 }
 
-func InstallTo(dir string, grub bool, device string) {
-	err := misc.RunCommandToStdOutErr(exec.Command("spack", "wield", "base", "dhcpcd", "iproute2", "--destdir="+dir))
+func MountSystem(dir string) error {
+	err := os.MkdirAll(dir+"/proc", 0555)
 	if err != nil {
-		log.Error.Println("Error installing base packages")
-		os.Exit(-1)
+		return err
 	}
 
-	if grub {
-		err := misc.RunCommandToStdOutErr(exec.Command("spack", "wield", "grub", "--destdir="+dir))
-		if err != nil {
-			log.Error.Println("Error installing grub")
-			os.Exit(-1)
-		}
+	err = Mount(dir+"/proc", "-t", "proc", "none")
+	if err != nil {
+		return fmt.Errorf("Unable to mount proc: %s", err)
+	}
 
-		err = misc.RunCommandToStdOutErr(exec.Command("mkdir", dir+"/proc"))
-		if err != nil {
-			log.Error.Println("Unable to create proc")
-			os.Exit(-1)
-		}
+	err = Mount(dir+"/dev", "--rbind", "/dev")
+	if err != nil {
+		return fmt.Errorf("Unable to mount dev: %s", err)
+	}
+	return nil
+}
 
-		err = misc.RunCommandToStdOutErr(exec.Command("mount", "-t", "proc", "none", dir+"/proc"))
-		if err != nil {
-			log.Error.Println("Unable to mount proc")
-			os.Exit(-1)
-		}
+func InstallTo(dir string, packages []string, options ...string) error {
+	args := append([]string{"wield"}, packages...)
+	args = append(args, "--destdir="+dir)
+	args = append(args, options...)
+	return misc.RunCommandToStdOutErr(exec.Command("spack", args...))
+}
 
-		err = misc.RunCommandToStdOutErr(exec.Command("mount", "--rbind", "/dev", dir+"/dev"))
-		if err != nil {
-			log.Error.Println("Unable to mount dev")
-			os.Exit(-1)
-		}
+func InstallGrub(dir string, device string) error {
+	misc.RunCommandToStdOutErr(exec.Command("sed", "-i", "s#set -e##", dir+"/etc/grub.d/10_serenity"))
+	return misc.RunCommandToStdOutErr(exec.Command("chroot", dir, "grub-install", device))
+}
 
-		misc.RunCommandToStdOutErr(exec.Command("sed", "-i", "s#set -e##", dir+"/etc/grub.d/10_serenity"))
-		err = misc.RunCommandToStdOutErr(exec.Command("chroot", dir, "grub-install", device))
-		if err != nil {
-			log.Error.Println("Unable to install grub")
-			os.Exit(-1)
-		}
+func ConfigureGrub(dir string) error {
+	return misc.RunCommandToStdOutErr(exec.Command("chroot", dir, "bash", "-c", "echo here; grub-mkconfig > /boot/grub/grub.cfg"))
+}
 
-		err = misc.RunCommandToStdOutErr(exec.Command("chroot", dir, "bash", "-c", "echo here; grub-mkconfig > /boot/grub/grub.cfg"))
-		if err != nil {
-			log.Error.Println("Unable to setup grub")
-			os.Exit(-1)
-		}
+func args() string {
+	argparse.SetBasename(fmt.Sprintf("%s [options]", os.Args[0]))
+	offlineArg := argparse.RegisterString("offline", "(not set)", "Install from a local directory of forged spakgs (smithy outdir layout)")
+
+	extra := argparse.EvalDefaultArgs()
+	if len(extra) > 0 {
+		log.Error.Format("Invalid options: %s", extra)
+		argparse.Usage(2)
 	}
-}
 
-func SetRootPass(dir, pass string) {
-	inner := "echo 'root:%s' | chpasswd"
-	inner = fmt.Sprintf(inner, pass)
-	err := misc.RunCommandToStdOutErr(exec.Command("chroot", dir, "bash", "-c", inner))
+	if !offlineArg.IsSet() {
+		return ""
+	}
+	offline, err := filepath.Abs(offlineArg.Get())
 	if err != nil {
-		log.Error.Println("Cannot set password")
+		log.Error.Println(err)
 		os.Exit(-1)
 	}
+	return offline
 }
 
 func main() {
+	offline := args()
 	log.SetLevel(log.DebugLevel)
 
 	RequireRoot()
@@ -223,28 +214,116 @@ func main() {
 	RequireProg("blkid")
 	RequireProg("mount")
 	RequireProg("mkfs.ext4")
+	RequireProg("stty")
+	RequireProg("spack")
+
+	//Before any prompt, so that echo is restored if the password prompt is interrupted
+	HandleSignals()
 
 	log.Info.Println("Welcome to the Serenity Linux Installer")
 	misc.LogBar(log.Info, log.Info.Color)
 
-	device := SelectDevice()
-	doFormat := AskYesNo(fmt.Sprintf("Do you wish to format %s with ext4?", device.file), true)
-	doGrub := AskYesNo(fmt.Sprintf("Do you wish to install grub on %s?", device.Parent()), true)
+	var device Device
+	state := LoadState()
+	if state != nil {
+		question := fmt.Sprintf("A previous install to %s stopped after %s, do you wish to resume it?", state.Device, state.LastDone())
+		if AskYesNo(question, true) {
+			//The packages already installed came from where the state says, mixing sources is not resuming
+			if offline != "" && offline != state.Offline {
+				source := "the configured repos"
+				if state.Offline != "" {
+					source = state.Offline
+				}
+				log.Error.Format("The install being resumed installs from %s, not %s, resume it without --offline or start a new install", source, offline)
+				os.Exit(-1)
+			}
+			device = Device{file: state.Device}
+		} else {
+			state.Remove()
+			state = nil
+		}
+	}
+
+	if state == nil {
+		device = SelectDevice()
+		state = &State{Device: device.file, Offline: offline, Completed: make([]string, 0)}
+		state.Format = AskYesNo(fmt.Sprintf("Do you wish to format %s with ext4?", device.file), true)
+		state.Grub = AskYesNo(fmt.Sprintf("Do you wish to install grub on %s?", device.Parent()), true)
 
-	rootPass := AskQuestion("Please choose a root password")
+		profiles, err := LoadProfiles()
+		if err != nil {
+			log.Error.Format("Unable to load profiles from %s: %s", profilesFile, err)
+			os.Exit(-1)
+		}
+		selected := SelectProfiles(profiles)
+		extra := AskExtraPackages()
+		if state.Grub {
+			extra = append(extra, "grub")
+		}
+		state.Packages = PackageList(selected, extra)
 
+		if state.Offline != "" {
+			cache, err := LoadLocalCache(state.Offline)
+			var unsigned []string
+			if err == nil {
+				unsigned, err = cache.Unsigned()
+			}
+			if err != nil {
+				log.Error.Println(err)
+				os.Exit(-1)
+			}
+			if len(unsigned) > 0 {
+				log.Warn.Format("Not signed by a key in %s: %s", sign.KeysDir, strings.Join(unsigned, " "))
+				state.AllowUnsigned = AskYesNo("Do you wish to install these unsigned packages anyway?", false)
+				if !state.AllowUnsigned {
+					os.Exit(-1)
+				}
+			}
+		}
+	}
+
+	rootPass := ""
+	rootHashed := false
+	if !state.IsDone(StepRootPass) {
+		rootPass, rootHashed = AskRootPassword()
+	}
+
+	log.Info.Format("Packages to install: %s", strings.Join(state.Packages, " "))
 	ok := AskYesNo("Are you sure you wish to continue?", true)
 	if !ok {
 		os.Exit(-1)
 	}
 
-	if doFormat {
-		FormatDevice(device)
+	state.Save()
+
+	if state.Format {
+		state.Run(StepFormat, func() error { return FormatDevice(device) })
 	}
 
-	dir := MountDevice(device)
+	dir, err := MountDevice(device)
+	if err != nil {
+		Fail("Unable to mount %s: %s", device.file, err)
+	}
+
+	state.Run(StepBase, func() error {
+		if state.Offline != "" {
+			return InstallOffline(dir, state.Offline, state.Packages, state.AllowUnsigned)
+		}
+		return InstallTo(dir, state.Packages)
+	})
+
+	if state.Grub && !(state.IsDone(StepGrubInstall) && state.IsDone(StepGrubConfig)) {
+		err = MountSystem(dir)
+		if err != nil {
+			Fail("%s", err)
+		}
+		state.Run(StepGrubInstall, func() error { return InstallGrub(dir, device.Parent()) })
+		state.Run(StepGrubConfig, func() error { return ConfigureGrub(dir) })
+	}
 
-	InstallTo(dir, doGrub, device.Parent())
+	state.Run(StepRootPass, func() error { return SetRootPass(dir, rootPass, rootHashed) })
 
-	SetRootPass(dir, rootPass)
+	state.Remove()
+	Cleanup()
+	log.Info.Println("Installation complete")
 }
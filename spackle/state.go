@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/cam72cam/go-lumberjack/log"
+	"github.com/serenitylinux/libspack/misc"
+)
+
+// Kept outside of /tmp so that a failed install can be resumed after a reboot
+const stateFile = "/var/tmp/spackle.state"
+
+const (
+	StepFormat      = "format"
+	StepBase        = "base"
+	StepGrubInstall = "grub-install"
+	StepGrubConfig  = "grub-config"
+	StepRootPass    = "root-password"
+)
+
+type State struct {
+	Device   string
+	Format   bool
+	Grub     bool
+	Packages []string
+	Offline  string
+	//Install unsigned packages from the offline medium, asked before anything is installed
+	AllowUnsigned bool
+	Completed     []string
+}
+
+func LoadState() *State {
+	if !misc.PathExists(stateFile) {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		log.Warn.Format("Unable to read %s: %s", stateFile, err)
+		return nil
+	}
+
+	var state State
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		log.Warn.Format("Ignoring invalid state in %s: %s", stateFile, err)
+		return nil
+	}
+	return &state
+}
+
+func (state *State) Save() {
+	data, err := json.MarshalIndent(state, "", "\t")
+	if err == nil {
+		err = ioutil.WriteFile(stateFile, data, 0600)
+	}
+	if err != nil {
+		log.Warn.Format("Unable to save progress to %s: %s", stateFile, err)
+	}
+}
+
+func (state *State) Remove() {
+	err := os.Remove(stateFile)
+	if err != nil && !os.IsNotExist(err) {
+		log.Warn.Format("Unable to remove %s: %s", stateFile, err)
+	}
+}
+
+func (state *State) IsDone(step string) bool {
+	for _, done := range state.Completed {
+		if done == step {
+			return true
+		}
+	}
+	return false
+}
+
+func (state *State) LastDone() string {
+	if len(state.Completed) == 0 {
+		return "(none)"
+	}
+	return state.Completed[len(state.Completed)-1]
+}
+
+// Runs fn unless step was completed by a previous attempt, failing the install on error
+func (state *State) Run(step string, fn func() error) {
+	if state.IsDone(step) {
+		log.Info.Format("Skipping %s, already completed", step)
+		return
+	}
+
+	err := fn()
+	if err != nil {
+		Fail("%s failed: %s", step, err)
+	}
+
+	state.Completed = append(state.Completed, step)
+	state.Save()
+}
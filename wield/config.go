@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/serenitylinux/libspack/repo"
+	"github.com/serenitylinux/spack/config"
+)
+
+// Hashes recorded for every config file installed under destdir
+func InstalledConfigHashes(destdir string) map[string]string {
+	hashes := make(map[string]string)
+	for _, r := range repo.GetAllRepos() {
+		r.MapInstalled(destdir, func(p repo.PkgInstallSet) {
+			for f, hash := range p.Hashes {
+				f = path.Clean("/" + f)
+				if config.IsConfig(f) {
+					hashes[f] = hash
+				}
+			}
+		})
+	}
+	return hashes
+}
+
+// Puts back config files that were edited since they were installed
+func (t *Transaction) ProtectConfigs(hashes map[string]string) {
+	for _, p := range t.backups {
+		hash, exists := hashes[p]
+		if !exists {
+			continue
+		}
+		backup := t.backupPath(p)
+		old, err := ioutil.ReadFile(backup)
+		if err != nil || config.Hash(old) == hash {
+			continue
+		}
+		info, err := os.Stat(backup)
+		if err != nil {
+			continue
+		}
+		config.Restore(filepath.Join(t.destdir, p), old, info.Mode(), hash)
+	}
+}
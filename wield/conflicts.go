@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/serenitylinux/libspack/repo"
+)
+
+// Maps every file installed under destdir to the names of the packages owning it
+func InstalledOwners(destdir string) map[string][]string {
+	owners := make(map[string][]string)
+	for _, r := range repo.GetAllRepos() {
+		r.MapInstalled(destdir, func(p repo.PkgInstallSet) {
+			for f := range p.Hashes {
+				f = path.Clean("/" + f)
+				owners[f] = append(owners[f], p.Control.Name)
+			}
+		})
+	}
+	return owners
+}
+
+// Files in the manifest owned by an installed package other than the ones being replaced
+func Conflicts(manifest map[string]Package, owners map[string][]string) []string {
+	replacing := make(map[string]bool)
+	for _, pkg := range manifest {
+		replacing[pkg.Spakg.Control.Name] = true
+	}
+
+	conflicts := make([]string, 0)
+	for p, pkg := range manifest {
+		for _, owner := range owners[p] {
+			//A package replaced in the same wield only conflicts if its new version still has the file
+			if !replacing[owner] {
+				conflicts = append(conflicts, fmt.Sprintf("%s: %s is owned by %s", pkg.Name(), p, owner))
+			}
+		}
+	}
+	sort.Strings(conflicts)
+	return conflicts
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/serenitylinux/libspack/misc"
+)
+
+const progressInterval = 250 * time.Millisecond
+
+// Sizes of the regular files in a spakg's entries, along with every path it installs
+func SpakgContents(entries map[string][]byte) (map[string]int64, []string, error) {
+	contents := make(map[string]int64)
+	paths := make([]string, 0)
+	for name, data := range entries {
+		if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b {
+			gr, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				continue
+			}
+			data, err = ioutil.ReadAll(gr)
+			if err != nil {
+				continue
+			}
+		}
+		//Only the filesystem archive is a tar
+		if len(data) < 262 || string(data[257:262]) != "ustar" {
+			continue
+		}
+
+		tr := tar.NewReader(bytes.NewReader(data))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, nil, wrapError("Unable to read "+name, err)
+			}
+			p := path.Clean("/" + hdr.Name)
+			if p == "/" {
+				continue
+			}
+			paths = append(paths, p)
+			if hdr.Typeflag == tar.TypeReg {
+				contents[p] = hdr.Size
+			}
+		}
+	}
+	return contents, paths, nil
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func humanSize(bytes int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	size := float64(bytes)
+	i := 0
+	for size >= 1024 && i < len(units)-1 {
+		size /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d %s", bytes, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", size, units[i])
+}
+
+// Tracks how much of a package wield has extracted by watching for its files under destdir
+type Progress struct {
+	label    string
+	destdir  string
+	contents map[string]int64
+	total    int64
+	done     map[string]bool
+	bytes    int64
+	start    time.Time
+	stop     chan bool
+	stopped  chan bool
+}
+
+func NewProgress(label string, destdir string, contents map[string]int64) *Progress {
+	p := &Progress{
+		label:    label,
+		destdir:  destdir,
+		contents: contents,
+		done:     make(map[string]bool),
+		start:    time.Now(),
+		stop:     make(chan bool),
+		stopped:  make(chan bool),
+	}
+	for _, size := range contents {
+		p.total += size
+	}
+	return p
+}
+
+// A file counts as extracted once its change time is after the install started, mtimes come from the package
+func (p *Progress) poll() {
+	for f, size := range p.contents {
+		if p.done[f] {
+			continue
+		}
+		info, err := os.Lstat(filepath.Join(p.destdir, f))
+		if err != nil {
+			continue
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && time.Unix(stat.Ctim.Unix()).Before(p.start.Truncate(time.Second)) {
+			continue
+		}
+		p.done[f] = true
+		p.bytes += size
+	}
+}
+
+func (p *Progress) render() {
+	line := fmt.Sprintf("%s  %d/%d files  %s/%s", p.label, len(p.done), len(p.contents), humanSize(p.bytes), humanSize(p.total))
+	if p.bytes > 0 && p.bytes < p.total {
+		elapsed := time.Since(p.start)
+		eta := time.Duration(float64(elapsed) * float64(p.total-p.bytes) / float64(p.bytes))
+		line += fmt.Sprintf("  ETA %s", eta.Round(time.Second))
+	}
+
+	width := misc.GetWidth()
+	if len(line) > width {
+		line = line[:width]
+	}
+	fmt.Print("\r" + line + strings.Repeat(" ", width-len(line)))
+}
+
+// Renders progress until Stop, only on terminals
+func (p *Progress) Start() {
+	if !isTerminal(os.Stdout) {
+		close(p.stopped)
+		return
+	}
+	go func() {
+		defer close(p.stopped)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				p.poll()
+				p.render()
+				fmt.Println()
+				return
+			case <-ticker.C:
+				p.poll()
+				p.render()
+			}
+		}
+	}()
+}
+
+func (p *Progress) Stop() {
+	close(p.stop)
+	<-p.stopped
+}
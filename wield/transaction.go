@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/cam72cam/go-lumberjack/log"
+	"github.com/serenitylinux/libspack/spakg"
+	"github.com/serenitylinux/spack/sign"
+)
+
+// A spakg validated before anything is installed
+type Package struct {
+	File  string
+	Spakg *spakg.Spakg
+	//The entries as verified, what is checked and run before install comes from these
+	Entries  map[string][]byte
+	Contents map[string]int64
+	//Every path installed, including directories and symlinks
+	Paths []string
+}
+
+func (p Package) Name() string {
+	return p.Spakg.Control.String()
+}
+
+// Reads and verifies every spakg up front so that a bad one is found before any package is installed
+func LoadPackages(files []string) ([]Package, error) {
+	keys, err := sign.LoadKeyring(sign.KeysDir)
+	if err != nil {
+		return nil, wrapError("Unable to load keyring", err)
+	}
+
+	pkgs := make([]Package, 0, len(files))
+	for _, file := range files {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return nil, wrapError("Cannot access package", err)
+		}
+
+		entries, err := sign.ReadEntries(abs)
+		if err != nil {
+			return nil, wrapError("Invalid package "+file, err)
+		}
+		signer, err := sign.VerifyEntries(abs, entries, keys)
+		if _, untrusted := err.(sign.UntrustedError); untrusted && allowUnsigned {
+			log.Warn.Println(err)
+		} else if untrusted {
+			return nil, fmt.Errorf("%s, use --allow-unsigned to install it anyway", err)
+		} else if err != nil {
+			return nil, err
+		} else {
+			log.Debug.Format("%s is signed by %s", file, signer)
+		}
+
+		spkg, err := spakg.FromFile(abs, nil)
+		if err == nil {
+			spkg.Md5sums, err = sign.Sums(entries)
+		}
+		if err != nil {
+			return nil, wrapError("Invalid package "+file, err)
+		}
+		contents, paths, err := SpakgContents(entries)
+		if err != nil {
+			return nil, wrapError("Invalid package "+file, err)
+		}
+		pkgs = append(pkgs, Package{abs, spkg, entries, contents, paths})
+	}
+	return pkgs, nil
+}
+
+// Maps every file installed by pkgs to the package installing it, failing if two packages contain the same file
+func Manifest(pkgs []Package) (map[string]Package, error) {
+	manifest := make(map[string]Package)
+	for _, pkg := range pkgs {
+		for f := range pkg.Spakg.Md5sums {
+			p := path.Clean("/" + f)
+			if other, exists := manifest[p]; exists {
+				return nil, fmt.Errorf("%s and %s both contain %s", other.Name(), pkg.Name(), p)
+			}
+			manifest[p] = pkg
+		}
+	}
+	return manifest, nil
+}
+
+// libspack records installed packages under here, next to spack's own state and the stored hooks
+const installDb = "/var/lib/spack"
+
+// Backups are kept on the destdir's own filesystem so that restoring them is a rename
+const backupParent = "/var/cache/spack"
+
+// Files replaced while installing a set of packages, so that a failure can be undone
+type Transaction struct {
+	destdir   string
+	backupDir string
+	backups   []string
+	links     map[string]string
+	created   []string
+	dirs      []string
+	seenDirs  map[string]bool
+	tracked   map[string]bool
+	//Whether installDb existed and was copied to the backup dir
+	dbBackup bool
+}
+
+func copyFile(src, dest string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Copies the tree at src to dest, keeping modes and symlinks
+func copyTree(src, dest string) error {
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copyFile(p, target, info.Mode())
+		}
+		return nil
+	})
+}
+
+// Backs up the install database and every path pkgs install that already exists under destdir
+func Begin(destdir string, pkgs []Package, manifest map[string]Package) (*Transaction, error) {
+	t := &Transaction{
+		destdir:  destdir,
+		links:    make(map[string]string),
+		seenDirs: make(map[string]bool),
+		tracked:  make(map[string]bool),
+	}
+
+	parent := filepath.Join(destdir, backupParent)
+	t.trackParents(filepath.Join(parent, "wield-backup"))
+	err := os.MkdirAll(parent, 0755)
+	if err == nil {
+		t.backupDir, err = ioutil.TempDir(parent, "wield-backup")
+	}
+	if err != nil {
+		t.removeBackups()
+		return nil, wrapError("Unable to create backup dir", err)
+	}
+	backupDir := t.backupDir
+
+	db := filepath.Join(destdir, installDb)
+	if pathExists(db) {
+		err = copyTree(db, filepath.Join(backupDir, "db"))
+		if err != nil {
+			t.Rollback()
+			return nil, wrapError("Unable to back up "+db, err)
+		}
+		t.dbBackup = true
+	} else {
+		t.trackParents(db)
+	}
+
+	paths := make([]string, 0, len(manifest))
+	for p := range manifest {
+		paths = append(paths, p)
+	}
+	for _, pkg := range pkgs {
+		paths = append(paths, pkg.Paths...)
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		err = t.Track(p)
+		if err != nil {
+			t.Rollback()
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Records the directories above full that do not exist yet, so that Rollback can remove them
+func (t *Transaction) trackParents(full string) {
+	for dir := filepath.Dir(full); !t.seenDirs[dir] && !pathExists(dir); dir = filepath.Dir(dir) {
+		t.seenDirs[dir] = true
+		t.dirs = append(t.dirs, dir)
+	}
+}
+
+// Records the current state of p, relative to destdir, so that Rollback can restore it
+func (t *Transaction) Track(p string) error {
+	full := filepath.Join(t.destdir, p)
+	if t.tracked[full] {
+		return nil
+	}
+	t.tracked[full] = true
+
+	info, err := os.Lstat(full)
+	switch {
+	case os.IsNotExist(err):
+		t.created = append(t.created, full)
+		t.trackParents(full)
+	case err != nil:
+		return err
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(full)
+		if err != nil {
+			return err
+		}
+		t.links[full] = target
+	case info.Mode().IsRegular():
+		backup := t.backupPath(p)
+		err = os.MkdirAll(filepath.Dir(backup), 0755)
+		if err == nil {
+			err = copyFile(full, backup, info.Mode())
+		}
+		if err != nil {
+			return wrapError("Unable to back up "+full, err)
+		}
+		t.backups = append(t.backups, p)
+	}
+	return nil
+}
+
+// Where the original of p is kept
+func (t *Transaction) backupPath(p string) string {
+	return filepath.Join(t.backupDir, "files", p)
+}
+
+func pathExists(p string) bool {
+	_, err := os.Lstat(p)
+	return err == nil
+}
+
+// Restores destdir to how it was before the transaction began
+func (t *Transaction) Rollback() {
+	log.Warn.Println("Rolling back")
+
+	//Deepest first so that directories the packages created are empty by the time they are removed
+	created := append(append([]string{}, t.created...), t.dirs...)
+	sort.Sort(sort.Reverse(sort.StringSlice(created)))
+	for _, full := range created {
+		info, err := os.Lstat(full)
+		if err != nil {
+			continue
+		}
+		err = os.Remove(full)
+		if err != nil && !info.IsDir() {
+			log.Warn.Format("Unable to remove %s: %s", full, err)
+		}
+	}
+
+	for full, target := range t.links {
+		os.Remove(full)
+		if err := os.Symlink(target, full); err != nil {
+			log.Warn.Format("Unable to restore %s: %s", full, err)
+		}
+	}
+	for _, p := range t.backups {
+		backup := t.backupPath(p)
+		full := filepath.Join(t.destdir, p)
+		err := os.Rename(backup, full)
+		if err != nil {
+			log.Warn.Format("Unable to restore %s: %s", full, err)
+		}
+	}
+
+	//The records of packages installed before the failure go with their files
+	db := filepath.Join(t.destdir, installDb)
+	err := os.RemoveAll(db)
+	if err == nil && t.dbBackup {
+		err = copyTree(filepath.Join(t.backupDir, "db"), db)
+	}
+	if err != nil {
+		log.Warn.Format("Unable to restore %s: %s", db, err)
+	}
+	t.removeBackups()
+}
+
+// Drops the backups along with any directories created for them that are left empty
+func (t *Transaction) removeBackups() {
+	if t.backupDir != "" {
+		os.RemoveAll(t.backupDir)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(t.dirs)))
+	for _, dir := range t.dirs {
+		os.Remove(dir)
+	}
+}
+
+// Installs pkgs into destdir with install, rolling all of them back if any fails, left open for the caller to commit
+func InstallSet(destdir string, pkgs []Package, manifest map[string]Package, install func(i int, pkg Package) error) (*Transaction, error) {
+	t, err := Begin(destdir, pkgs, manifest)
+	if err != nil {
+		return nil, err
+	}
+	for i, pkg := range pkgs {
+		err = install(i, pkg)
+		if err != nil {
+			t.Rollback()
+			return nil, wrapError("Unable to wield "+pkg.Name(), err)
+		}
+	}
+	return t, nil
+}
+
+// Keeps the installed files and drops the backups
+func (t *Transaction) Commit() {
+	t.removeBackups()
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/serenitylinux/libspack/spakg"
+)
+
+// A path installed by a fake package, a directory when both data and link are empty
+type fakeEntry struct {
+	path string
+	data string
+	link string
+}
+
+func fakePackage(entries []fakeEntry) Package {
+	pkg := Package{
+		Spakg:    &spakg.Spakg{Md5sums: make(map[string]string)},
+		Contents: make(map[string]int64),
+		Paths:    make([]string, 0),
+	}
+	for _, e := range entries {
+		pkg.Paths = append(pkg.Paths, e.path)
+		if e.data != "" {
+			pkg.Spakg.Md5sums[e.path] = "unused"
+			pkg.Contents[e.path] = int64(len(e.data))
+		}
+	}
+	return pkg
+}
+
+// Installs entries under destdir and records them in the install database, as wield.Wield does
+func fakeInstall(destdir string, name string, entries []fakeEntry) error {
+	for _, e := range entries {
+		full := filepath.Join(destdir, e.path)
+		err := os.MkdirAll(filepath.Dir(full), 0755)
+		if err != nil {
+			return err
+		}
+		switch {
+		case e.link != "":
+			os.Remove(full)
+			err = os.Symlink(e.link, full)
+		case e.data != "":
+			err = ioutil.WriteFile(full, []byte(e.data), 0644)
+		default:
+			err = os.MkdirAll(full, 0755)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	record := filepath.Join(destdir, installDb, "installed", name+".pkgset")
+	err := os.MkdirAll(filepath.Dir(record), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(record, []byte(name), 0644)
+}
+
+// Every path under dir with its content or link target
+func snapshotTree(t *testing.T, dir string) map[string]string {
+	tree := make(map[string]string)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		switch {
+		case info.IsDir():
+			tree[rel] = "dir"
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			tree[rel] = "link " + target
+		default:
+			data, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			tree[rel] = "file " + string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func writeTestFile(t *testing.T, file string, data string) {
+	err := os.MkdirAll(filepath.Dir(file), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(file, []byte(data), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInstallSetRollsBackWhenSecondPackageFails(t *testing.T) {
+	destdir, err := ioutil.TempDir("", "wield-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(destdir)
+
+	writeTestFile(t, filepath.Join(destdir, "usr/bin/tool"), "tool 1.0")
+	writeTestFile(t, filepath.Join(destdir, installDb, "installed/tool.pkgset"), "tool 1.0")
+	err = os.Symlink("libtool.so.1", filepath.Join(destdir, "usr/bin/libtool.so"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := snapshotTree(t, destdir)
+
+	sets := [][]fakeEntry{
+		{
+			{path: "/usr/bin/tool", data: "tool 2.0"},
+			{path: "/usr/bin/libtool.so", link: "libtool.so.2"},
+			{path: "/usr/share/tool"},
+			{path: "/usr/share/tool/data", data: "data"},
+			{path: "/usr/lib/libnew.so", link: "libnew.so.1"},
+		},
+		{
+			{path: "/usr/share/doc/other/README", data: "readme"},
+		},
+	}
+	pkgs := []Package{fakePackage(sets[0]), fakePackage(sets[1])}
+	manifest, err := Manifest(pkgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	installed := 0
+	txn, err := InstallSet(destdir, pkgs, manifest, func(i int, pkg Package) error {
+		err := fakeInstall(destdir, path.Base(pkg.Paths[0]), sets[i])
+		if err != nil {
+			return err
+		}
+		installed++
+		if i == 1 {
+			return errors.New("disk full")
+		}
+		return nil
+	})
+	if err == nil {
+		txn.Commit()
+		t.Fatal("Expected the failure of the second package to be returned")
+	}
+	if installed != 2 {
+		t.Fatalf("Expected both packages to be attempted, got %d", installed)
+	}
+
+	after := snapshotTree(t, destdir)
+	for p, state := range before {
+		if after[p] != state {
+			t.Errorf("%s was %q before the install but %q after rolling back", p, state, after[p])
+		}
+	}
+	for p, state := range after {
+		if _, existed := before[p]; !existed {
+			t.Errorf("%s (%s) was left behind by the rolled back install", p, state)
+		}
+	}
+}
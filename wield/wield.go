@@ -6,8 +6,10 @@ import (
 	"github.com/cam72cam/go-lumberjack/color"
 	"github.com/cam72cam/go-lumberjack/log"
 	"github.com/serenitylinux/libspack/argparse"
-	"github.com/serenitylinux/libspack/spakg"
+	"github.com/serenitylinux/libspack/repo"
 	"github.com/serenitylinux/libspack/wield"
+	"github.com/serenitylinux/spack/hooks"
+	"github.com/serenitylinux/spack/sign"
 	"os"
 	"path/filepath"
 )
@@ -16,6 +18,8 @@ var pretend = false
 var verbose = false
 var quiet = false
 var destdir = "/"
+var force = false
+var allowUnsigned = false
 
 func args() []string {
 	argparse.SetBasename(fmt.Sprintf("%s [options] package(s)", os.Args[0]))
@@ -23,6 +27,8 @@ func args() []string {
 	verboseArg := argparse.RegisterBool("verbose", verbose, "")
 	quietArg := argparse.RegisterBool("quiet", quiet, "")
 	destArg := argparse.RegisterString("destdir", destdir, "Root to install package into")
+	forceArg := argparse.RegisterBool("force", force, "Overwrite files owned by other installed packages")
+	allowUnsignedArg := argparse.RegisterBool("allow-unsigned", allowUnsigned, "Install packages not signed by a key in "+sign.KeysDir)
 
 	packages := argparse.EvalDefaultArgs()
 
@@ -34,6 +40,8 @@ func args() []string {
 	pretend = pretendArg.Get()
 	verbose = verboseArg.Get()
 	quiet = quietArg.Get()
+	force = forceArg.Get()
+	allowUnsigned = allowUnsignedArg.Get()
 	var err error
 	destdir, err = filepath.Abs(destArg.Get())
 	if err != nil {
@@ -59,33 +67,93 @@ func wrapError(msg string, err error) error {
 }
 
 func main() {
-	pkgs := args()
-	var err error = nil
+	pkgs, err := LoadPackages(args())
+	if err != nil {
+		log.Error.Println(err)
+		os.Exit(-1)
+	}
 
-	for _, pkg := range pkgs {
-		pkg, err = filepath.Abs(pkg)
+	manifest, err := Manifest(pkgs)
+	if err != nil {
+		log.Error.Println(err)
+		os.Exit(-1)
+	}
 
-		if err != nil {
-			err = wrapError("Cannot access package", err)
-			break
+	configHashes := make(map[string]string)
+	err = repo.LoadRepos()
+	if err != nil {
+		log.Warn.Format("Unable to load repos, conflicts with installed packages will not be checked: %s", err)
+	} else {
+		configHashes = InstalledConfigHashes(destdir)
+		conflicts := Conflicts(manifest, InstalledOwners(destdir))
+		for _, conflict := range conflicts {
+			if force {
+				log.Warn.Println(conflict)
+			} else {
+				log.Error.Println(conflict)
+			}
+		}
+		if len(conflicts) > 0 && !force {
+			log.Error.Println("Refusing to overwrite files owned by other packages, use --force to override")
+			os.Exit(-1)
 		}
+	}
 
-		spkg, err := spakg.FromFile(pkg, nil)
+	hookFailures := make([]error, 0)
+	runner := hooks.NewRunner(destdir)
+	var installedFiles int
+	var installedBytes int64
+	txn, err := InstallSet(destdir, pkgs, manifest, func(i int, pkg Package) error {
+		spkg := pkg.Spakg
+		fmt.Println(color.Green.Stringf("(%d/%d) Wielding %s with the force of a ", i+1, len(pkgs), spkg.Control.String()) + color.Red.String("GOD"))
+
+		script := pkg.Entries[hooks.Entry]
+		err := runner.Run(spkg.Control.Name, hooks.PreInstall, script)
+		if err == nil {
+			progress := NewProgress(spkg.Control.String(), destdir, pkg.Contents)
+			progress.Start()
+			err = wield.Wield(pkg.File, destdir)
+			progress.Stop()
+		}
+		//The stored hooks live in the install database, which the transaction restores on failure
+		if err == nil {
+			err = hooks.Store(destdir, spkg.Control.Name, script)
+		}
 		if err != nil {
-			break
+			return err
 		}
-		fmt.Println(color.Green.Stringf("Wielding %s with the force of a %s", spkg.Control.String()), color.Red.String("GOD"))
 
-		err = wield.Wield(pkg, destdir)
+		//The files are in place, a failing post_install is reported rather than rolled back
+		err = runner.Run(spkg.Control.Name, hooks.PostInstall, script)
 		if err != nil {
-			break
+			log.Error.Println(err)
+			hookFailures = append(hookFailures, err)
 		}
 
 		log.Info.Println()
 		fmt.Println(color.Green.Stringf("Your heart is pure and accepts the gift of %s", spkg.Control.String()))
-	}
+
+		installedFiles += len(pkg.Contents)
+		for _, size := range pkg.Contents {
+			installedBytes += size
+		}
+		return nil
+	})
 	if err != nil {
 		log.Error.Println(err)
 		os.Exit(-1)
 	}
+	txn.ProtectConfigs(configHashes)
+	txn.Commit()
+	hookFailures = append(hookFailures, runner.Finish()...)
+
+	fmt.Printf("Wielded %d package(s), %d files, %s\n", len(pkgs), installedFiles, humanSize(installedBytes))
+
+	if len(hookFailures) > 0 {
+		log.Error.Println("Some install hooks failed:")
+		for _, err := range hookFailures {
+			log.Error.Println("  " + err.Error())
+		}
+		os.Exit(-1)
+	}
 }